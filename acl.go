@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+type ACLRuleType string
+
+const (
+	ACLRuleUser  ACLRuleType = "user"
+	ACLRuleGroup ACLRuleType = "group"
+	ACLRuleTag   ACLRuleType = "tag"
+	ACLRuleNode  ACLRuleType = "node"
+	ACLRuleCIDR  ACLRuleType = "cidr"
+	// Match the client certificate verified by a TLS listener with client authentication.
+	ACLRuleCertSubject ACLRuleType = "cert-subject"
+	ACLRuleCertSAN     ACLRuleType = "cert-san"
+)
+
+type ACLRule struct {
+	Type  ACLRuleType
+	Value string
+
+	// The user logins of a group rule.
+	members []string
+	// The prefix of a CIDR rule.
+	prefix netip.Prefix
+}
+
+func (r *ACLRule) String() string {
+	return string(r.Type) + ":" + r.Value
+}
+
+// parseACLRule parses a rule in the form of "type:value". A bare CIDR or IP is a CIDR rule.
+func parseACLRule(s string, groups map[string][]string) (*ACLRule, error) {
+	if prefix, err := parsePrefix(s); err == nil {
+		return &ACLRule{Type: ACLRuleCIDR, Value: s, prefix: prefix}, nil
+	}
+
+	ruleType, value, found := strings.Cut(s, ":")
+	if !found || value == "" {
+		return nil, fmt.Errorf("invalid ACL rule: %s", s)
+	}
+
+	rule := &ACLRule{Type: ACLRuleType(ruleType), Value: value}
+	switch rule.Type {
+	case ACLRuleUser, ACLRuleTag, ACLRuleNode, ACLRuleCertSubject, ACLRuleCertSAN:
+	case ACLRuleGroup:
+		members, ok := groups[value]
+		if !ok {
+			return nil, fmt.Errorf("unknown group in ACL rule: %s", value)
+		}
+		rule.members = members
+	case ACLRuleCIDR:
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR in ACL rule: %v", err)
+		}
+		rule.prefix = prefix
+	default:
+		return nil, fmt.Errorf("unknown ACL rule type: %s", ruleType)
+	}
+	return rule, nil
+}
+
+// Match reports whether the rule matches a connection from remoteAddr. identity is nil if the connection
+// is not from a tailnet peer, and certificate is nil if the client didn't present a verified certificate, in
+// which case the rules matching them couldn't match.
+func (r *ACLRule) Match(remoteAddr net.Addr, identity *TailscaleIdentity, certificate *x509.Certificate) bool {
+	switch r.Type {
+	case ACLRuleCIDR:
+		tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+		return ok && r.prefix.Contains(tcpAddr.AddrPort().Addr().Unmap())
+	case ACLRuleUser:
+		return identity != nil && identity.UserLogin != "" && strings.EqualFold(identity.UserLogin, r.Value)
+	case ACLRuleGroup:
+		if identity == nil || identity.UserLogin == "" {
+			return false
+		}
+		for _, member := range r.members {
+			if strings.EqualFold(identity.UserLogin, member) {
+				return true
+			}
+		}
+		return false
+	case ACLRuleTag:
+		if identity == nil {
+			return false
+		}
+		for _, tag := range identity.Tags {
+			if tag == "tag:"+r.Value {
+				return true
+			}
+		}
+		return false
+	case ACLRuleNode:
+		// Either the full MagicDNS name or the host name only.
+		if identity == nil {
+			return false
+		}
+		hostName, _, _ := strings.Cut(identity.NodeName, ".")
+		return strings.EqualFold(identity.NodeName, r.Value) || strings.EqualFold(hostName, r.Value)
+	case ACLRuleCertSubject:
+		// Either the full distinguished name (e.g. "CN=alice,O=Example") or the common name only.
+		return certificate != nil && (certificate.Subject.String() == r.Value || certificate.Subject.CommonName == r.Value)
+	case ACLRuleCertSAN:
+		return certificate != nil && slices.Contains(certificateSANs(certificate), r.Value)
+	default:
+		return false
+	}
+}
+
+// ACL decides whether connections are allowed to be forwarded. Deny rules take precedence over allow
+// rules. If there're any allow rules, a connection must match one of them to be allowed.
+type ACL struct {
+	Allow []*ACLRule
+	Deny  []*ACLRule
+}
+
+func ParseACL(allow, deny []string, groups map[string][]string) (*ACL, error) {
+	acl := &ACL{}
+	for _, s := range allow {
+		rule, err := parseACLRule(s, groups)
+		if err != nil {
+			return nil, err
+		}
+		acl.Allow = append(acl.Allow, rule)
+	}
+	for _, s := range deny {
+		rule, err := parseACLRule(s, groups)
+		if err != nil {
+			return nil, err
+		}
+		acl.Deny = append(acl.Deny, rule)
+	}
+	return acl, nil
+}
+
+func (a *ACL) IsEmpty() bool {
+	return len(a.Allow) == 0 && len(a.Deny) == 0
+}
+
+// HasIdentityRules reports whether any rule matches by the Tailscale identity, which a connection can't be
+// checked against if the lookup fails.
+func (a *ACL) HasIdentityRules() bool {
+	return a.hasRulesOf(ACLRuleUser, ACLRuleGroup, ACLRuleTag, ACLRuleNode)
+}
+
+// HasCertificateRules reports whether any rule matches by the client certificate, which is only verified if
+// required by the TLS listener.
+func (a *ACL) HasCertificateRules() bool {
+	return a.hasRulesOf(ACLRuleCertSubject, ACLRuleCertSAN)
+}
+
+func (a *ACL) hasRulesOf(types ...ACLRuleType) bool {
+	isOfTypes := func(rule *ACLRule) bool {
+		return slices.Contains(types, rule.Type)
+	}
+	return slices.ContainsFunc(a.Allow, isOfTypes) || slices.ContainsFunc(a.Deny, isOfTypes)
+}
+
+// Check returns whether a connection is allowed, and the reason if it's not.
+func (a *ACL) Check(remoteAddr net.Addr, identity *TailscaleIdentity, certificate *x509.Certificate) (allowed bool, reason string) {
+	for _, rule := range a.Deny {
+		if rule.Match(remoteAddr, identity, certificate) {
+			return false, fmt.Sprintf("denied by rule %q", rule.String())
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true, ""
+	}
+	for _, rule := range a.Allow {
+		if rule.Match(remoteAddr, identity, certificate) {
+			return true, ""
+		}
+	}
+	return false, "not allowed by any rule"
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// The maximum size of a service config posted to the admin API.
+const maxAdminRequestSize = 1 << 20
+
+// AdminServer serves the admin API for inspecting and controlling the services at runtime.
+type AdminServer struct {
+	context *ServiceContext
+	manager *ServiceManager
+	// Reloads the config file like SIGHUP.
+	reload func() error
+	logger *Logger
+}
+
+type adminTarget struct {
+	URL       string `json:"url"`
+	Type      string `json:"type"`
+	Address   string `json:"address"`
+	Port      int16  `json:"port,omitempty"`
+	Weight    int    `json:"weight"`
+	Active    int64  `json:"active"`
+	Available bool   `json:"available"`
+}
+
+type adminHealthCheck struct {
+	Type     HealthCheckType `json:"type"`
+	Interval string          `json:"interval"`
+	Timeout  string          `json:"timeout"`
+	Rise     int             `json:"rise"`
+	Fall     int             `json:"fall"`
+}
+
+type adminOutlierDetection struct {
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	EjectionTime        string `json:"ejectionTime"`
+}
+
+type adminService struct {
+	Name                 string                 `json:"name"`
+	Listen               string                 `json:"listen"`
+	ListenType           string                 `json:"listenType"`
+	ListenAddress        string                 `json:"listenAddress"`
+	ListenPort           int16                  `json:"listenPort,omitempty"`
+	Mode                 ServiceMode            `json:"mode"`
+	Routes               []string               `json:"routes,omitempty"`
+	Targets              []adminTarget          `json:"targets"`
+	Balance              BalanceStrategy        `json:"balance"`
+	Retries              int                    `json:"retries"`
+	HealthCheck          *adminHealthCheck      `json:"healthCheck,omitempty"`
+	OutlierDetection     *adminOutlierDetection `json:"outlierDetection,omitempty"`
+	ProxyProtocol        string                 `json:"proxyProtocol"`
+	AcceptProxyProtocol  bool                   `json:"acceptProxyProtocol"`
+	TrustedProxies       []string               `json:"trustedProxies,omitempty"`
+	ProxyProtocolTimeout string                 `json:"proxyProtocolTimeout"`
+	Allow                []string               `json:"allow,omitempty"`
+	Deny                 []string               `json:"deny,omitempty"`
+	LogLevel             string                 `json:"logLevel"`
+	Timeout              string                 `json:"timeout"`
+	SessionTimeout       string                 `json:"sessionTimeout"`
+	SniffTimeout         string                 `json:"sniffTimeout,omitempty"`
+	IdleTimeout          string                 `json:"idleTimeout,omitempty"`
+	MaxLifetime          string                 `json:"maxLifetime,omitempty"`
+	Paused               bool                   `json:"paused"`
+	Connections          int                    `json:"connections"` // Stream connections only, not UDP sessions.
+}
+
+type adminConnection struct {
+	ID       string             `json:"id"`
+	Service  string             `json:"service"`
+	Client   string             `json:"client"`
+	Identity *TailscaleIdentity `json:"identity,omitempty"`
+	Funnel   bool               `json:"funnel,omitempty"`
+	// Subject of the verified client certificate.
+	Certificate string `json:"certificate,omitempty"`
+	// Server name from the TLS ClientHello.
+	ServerName string    `json:"serverName,omitempty"`
+	Route      string    `json:"route,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	TargetAddr string    `json:"targetAddr,omitempty"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+	StartTime  time.Time `json:"startTime"`
+	Age        string    `json:"age"`
+}
+
+type adminTailscalePeer struct {
+	HostName string   `json:"hostName"`
+	DNSName  string   `json:"dnsName"`
+	OS       string   `json:"os"`
+	IPs      []string `json:"ips"`
+	Online   bool     `json:"online"`
+	// The preferred DERP relay, and the address of the direct connection (empty if relayed).
+	Relay      string `json:"relay,omitempty"`
+	CurAddr    string `json:"curAddr,omitempty"`
+	LastSeen   string `json:"lastSeen,omitempty"`
+	UserLogin  string `json:"userLogin,omitempty"`
+	IsTagged   bool   `json:"isTagged,omitempty"`
+	ExitNode   bool   `json:"exitNode,omitempty"`
+	Active     bool   `json:"active"`
+	RxBytes    int64  `json:"rxBytes"`
+	TxBytes    int64  `json:"txBytes"`
+	KeyExpired bool   `json:"keyExpired,omitempty"`
+}
+
+type adminTailscaleStatus struct {
+	BackendState string               `json:"backendState"`
+	AuthURL      string               `json:"authURL,omitempty"`
+	Health       []string             `json:"health,omitempty"`
+	Self         *adminTailscalePeer  `json:"self,omitempty"`
+	Peers        []adminTailscalePeer `json:"peers"`
+}
+
+func (a *AdminServer) serviceView(s *Service, connections []*Connection) adminService {
+	view := adminService{
+		Name:                 s.Name,
+		Listen:               s.Config.Listen,
+		ListenType:           s.ListenType.String(),
+		ListenAddress:        s.ListenAddress,
+		ListenPort:           s.ListenPort,
+		Mode:                 s.Mode,
+		Balance:              s.Config.Balance,
+		Retries:              s.Retries,
+		ProxyProtocol:        s.ConnectProxyProtocol.String(),
+		AcceptProxyProtocol:  s.AcceptProxyProtocol,
+		ProxyProtocolTimeout: s.ProxyProtocolTimeout.String(),
+		Allow:                s.Config.Allow,
+		Deny:                 s.Config.Deny,
+		LogLevel:             s.LogLevel.String(),
+		Timeout:              s.Timeout.String(),
+		SessionTimeout:       s.SessionTimeout.String(),
+		Paused:               s.Paused(),
+	}
+	if s.Mode == ServiceModeMux {
+		view.SniffTimeout = s.SniffTimeout.String()
+	}
+	if s.IdleTimeout != 0 {
+		view.IdleTimeout = s.IdleTimeout.String()
+	}
+	if s.MaxLifetime != 0 {
+		view.MaxLifetime = s.MaxLifetime.String()
+	}
+	for _, route := range s.Routes {
+		view.Routes = append(view.Routes, route.String())
+	}
+	if view.Balance == "" {
+		view.Balance = BalanceRoundRobin
+	}
+	for _, target := range s.Targets {
+		view.Targets = append(view.Targets, adminTarget{
+			URL:       target.URL,
+			Type:      target.Type.String(),
+			Address:   target.Address,
+			Port:      target.Port,
+			Weight:    target.Weight,
+			Active:    target.Active(),
+			Available: target.Available(),
+		})
+	}
+	if h := s.HealthCheck; h != nil {
+		view.HealthCheck = &adminHealthCheck{
+			Type:     h.Type,
+			Interval: h.Interval.String(),
+			Timeout:  h.Timeout.String(),
+			Rise:     h.Rise,
+			Fall:     h.Fall,
+		}
+	}
+	if o := s.OutlierDetection; o != nil {
+		view.OutlierDetection = &adminOutlierDetection{
+			ConsecutiveFailures: o.ConsecutiveFailures,
+			EjectionTime:        o.EjectionTime.String(),
+		}
+	}
+	for _, prefix := range s.TrustedProxies {
+		view.TrustedProxies = append(view.TrustedProxies, prefix.String())
+	}
+	for _, c := range connections {
+		if c.Service == s.Name {
+			view.Connections++
+		}
+	}
+	return view
+}
+
+func connectionView(c *Connection) adminConnection {
+	view := adminConnection{
+		ID:        c.ID,
+		Service:   c.Service,
+		Funnel:    c.Funnel,
+		BytesIn:   c.BytesIn.Load(),
+		BytesOut:  c.BytesOut.Load(),
+		StartTime: c.StartTime,
+		Age:       time.Since(c.StartTime).Truncate(time.Second).String(),
+	}
+	c.mu.Lock()
+	view.Client = c.Conn.RemoteAddr().String()
+	view.Identity = c.Identity
+	if c.Certificate != nil {
+		view.Certificate = c.Certificate.Subject.String()
+	}
+	view.ServerName = c.ServerName
+	view.Route = c.Route
+	if c.target != nil {
+		view.Target = c.target.URL
+		view.TargetAddr = c.targetConn.RemoteAddr().String()
+	}
+	c.mu.Unlock()
+	return view
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /services", a.listServices)
+	mux.HandleFunc("GET /services/{name}", a.getService)
+	mux.HandleFunc("PUT /services/{name}", a.addService)
+	mux.HandleFunc("DELETE /services/{name}", a.removeService)
+	mux.HandleFunc("POST /services/{name}/pause", a.pauseService)
+	mux.HandleFunc("POST /services/{name}/resume", a.resumeService)
+	mux.HandleFunc("GET /connections", a.listConnections)
+	mux.HandleFunc("DELETE /connections/{id}", a.killConnection)
+	mux.HandleFunc("POST /reload", a.reloadConfig)
+	mux.HandleFunc("GET /tailscale/status", a.tailscaleStatus)
+	return refuseBrowsers(mux)
+}
+
+// refuseBrowsers refuses the requests changing anything sent by browsers, which are told by their Origin or
+// Sec-Fetch-Site headers, so that web pages can't make the browser of the operator send them to the API on a
+// loopback address.
+func refuseBrowsers(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && (r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != "") {
+			writeError(w, http.StatusForbidden, fmt.Errorf("requests from browsers are not allowed"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (a *AdminServer) listServices(w http.ResponseWriter, r *http.Request) {
+	connections := a.context.Connections()
+	views := []adminService{}
+	for _, service := range a.manager.Services() {
+		views = append(views, a.serviceView(service, connections))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *AdminServer) getService(w http.ResponseWriter, r *http.Request) {
+	service := a.manager.Service(r.PathValue("name"))
+	if service == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %q not found", r.PathValue("name")))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.serviceView(service, a.context.Connections()))
+}
+
+// addService starts a service with the config in the request body, in YAML (or JSON) like the services in
+// the config file.
+func (a *AdminServer) addService(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminRequestSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	config := &ServiceConfig{}
+	if err := yaml.Unmarshal(body, config); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid service config: %v", err))
+		return
+	}
+	if a.manager.Service(name) != nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("service %q already exists", name))
+		return
+	}
+	if err := a.manager.Add(name, config); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// The service may have been removed by a reload meanwhile.
+	service := a.manager.Service(name)
+	if service == nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("service %q removed right after being added", name))
+		return
+	}
+	writeJSON(w, http.StatusCreated, a.serviceView(service, nil))
+}
+
+func (a *AdminServer) removeService(w http.ResponseWriter, r *http.Request) {
+	if err := a.manager.Remove(r.PathValue("name")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) pauseService(w http.ResponseWriter, r *http.Request) {
+	service := a.manager.Service(r.PathValue("name"))
+	if service == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %q not found", r.PathValue("name")))
+		return
+	}
+	if service.Pause() {
+		a.logger.Infof("paused service %q", service.Name)
+	}
+	writeJSON(w, http.StatusOK, a.serviceView(service, a.context.Connections()))
+}
+
+func (a *AdminServer) resumeService(w http.ResponseWriter, r *http.Request) {
+	service := a.manager.Service(r.PathValue("name"))
+	if service == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %q not found", r.PathValue("name")))
+		return
+	}
+	if service.Resume() {
+		a.logger.Infof("resumed service %q", service.Name)
+	}
+	writeJSON(w, http.StatusOK, a.serviceView(service, a.context.Connections()))
+}
+
+func (a *AdminServer) listConnections(w http.ResponseWriter, r *http.Request) {
+	serviceName := r.URL.Query().Get("service")
+	views := []adminConnection{}
+	for _, c := range a.context.Connections() {
+		if serviceName == "" || c.Service == serviceName {
+			views = append(views, connectionView(c))
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *AdminServer) killConnection(w http.ResponseWriter, r *http.Request) {
+	c := a.context.Connection(r.PathValue("id"))
+	if c == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("connection %q not found", r.PathValue("id")))
+		return
+	}
+	a.logger.Infof("killing connection %s of service %q", c.ID, c.Service)
+	c.Close(closeReasonKilled)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if err := a.reload(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) tailscaleStatus(w http.ResponseWriter, r *http.Request) {
+	if !a.context.TailscaleStarted() {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("Tailscale is not used"))
+		return
+	}
+	localClient, err := a.context.TsNet.LocalClient()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := localClient.Status(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	peerView := func(peer *ipnstate.PeerStatus) adminTailscalePeer {
+		view := adminTailscalePeer{
+			HostName:   peer.HostName,
+			DNSName:    strings.TrimSuffix(peer.DNSName, "."),
+			OS:         peer.OS,
+			Online:     peer.Online,
+			Relay:      peer.Relay,
+			CurAddr:    peer.CurAddr,
+			IsTagged:   peer.Tags != nil && peer.Tags.Len() > 0,
+			ExitNode:   peer.ExitNode,
+			Active:     peer.Active,
+			RxBytes:    peer.RxBytes,
+			TxBytes:    peer.TxBytes,
+			KeyExpired: peer.Expired,
+		}
+		for _, ip := range peer.TailscaleIPs {
+			view.IPs = append(view.IPs, ip.String())
+		}
+		if !peer.LastSeen.IsZero() {
+			view.LastSeen = peer.LastSeen.Format(time.RFC3339)
+		}
+		if profile, ok := status.User[peer.UserID]; ok && !view.IsTagged {
+			view.UserLogin = profile.LoginName
+		}
+		return view
+	}
+
+	view := adminTailscaleStatus{
+		BackendState: status.BackendState,
+		AuthURL:      status.AuthURL,
+		Health:       status.Health,
+		Peers:        []adminTailscalePeer{},
+	}
+	if status.Self != nil {
+		self := peerView(status.Self)
+		view.Self = &self
+	}
+	for _, key := range status.Peers() {
+		view.Peers = append(view.Peers, peerView(status.Peer[key]))
+	}
+	slices.SortFunc(view.Peers, func(a, b adminTailscalePeer) int {
+		return strings.Compare(a.DNSName, b.DNSName)
+	})
+	writeJSON(w, http.StatusOK, view)
+}
+
+// StartAdminServer serves the admin API on a UNIX socket or loopback TCP listen URL until stopped. Other
+// addresses are refused since the API is not authenticated.
+func StartAdminServer(serviceContext *ServiceContext, manager *ServiceManager, reload func() error, logger *Logger, listenUrl string) (stop func(), err error) {
+	addressType, address, port, err := parseUrl(urlTypeListen, listenUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin listen URL: %v", err)
+	}
+	switch addressType {
+	case AddressUNIXSocket:
+	case AddressTCP:
+		if ip := net.ParseIP(address); address != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("invalid admin listen URL: %s is not a loopback address", address)
+		}
+	default:
+		return nil, fmt.Errorf("invalid admin listen URL: only UNIX socket and loopback TCP addresses allowed")
+	}
+	listener, cleanup, err := serviceContext.Listen(addressType, address, port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start admin server on %s: %v", listenUrl, err)
+	}
+
+	admin := &AdminServer{
+		context: serviceContext,
+		manager: manager,
+		reload:  reload,
+		logger:  logger,
+	}
+	server := &http.Server{
+		Handler:           admin.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			cleanup()
+			logger.Fatalf("failed to serve admin API on %s: %v", listenUrl, err)
+		}
+	}()
+	logger.Infof("serving admin API on %s", listenUrl)
+	return func() {
+		server.Close()
+		cleanup()
+	}, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Target is one of the connect addresses of a service.
+type Target struct {
+	URL     string
+	Type    AddressType
+	Address string
+	Port    int16
+	Weight  int
+
+	// Dials the target within the context, writing the PROXY protocol header first if not nil.
+	Dial func(ctx context.Context, header []byte) (net.Conn, error)
+
+	// The number of connections (or datagram sessions) currently forwarded to the target.
+	active atomic.Int64
+
+	// Set by active health checks.
+	unhealthy atomic.Bool
+	// Set by outlier detection, in Unix nanoseconds.
+	ejectedUntil        atomic.Int64
+	consecutiveFailures atomic.Int64
+}
+
+func (t *Target) Active() int64 {
+	return t.active.Load()
+}
+
+// Available reports whether the target is healthy and not ejected.
+func (t *Target) Available() bool {
+	return !t.unhealthy.Load() && time.Now().UnixNano() >= t.ejectedUntil.Load()
+}
+
+// Release marks a connection to the target returned by Service.Connect as finished.
+func (t *Target) Release() {
+	t.active.Add(-1)
+}
+
+type BalanceStrategy string
+
+const (
+	BalanceRoundRobin       BalanceStrategy = "round-robin"
+	BalanceRandom           BalanceStrategy = "random"
+	BalanceLeastConnections BalanceStrategy = "least-connections"
+	BalanceWeighted         BalanceStrategy = "weighted"
+	BalanceHash             BalanceStrategy = "hash"
+	BalanceFailover         BalanceStrategy = "failover"
+)
+
+// Balancer picks the target for a new connection.
+type Balancer interface {
+	// Pick returns one of the non-empty candidates for a connection from clientAddr.
+	Pick(candidates []*Target, clientAddr net.Addr) *Target
+}
+
+func CreateBalancer(strategy BalanceStrategy) (Balancer, error) {
+	switch strategy {
+	case BalanceRoundRobin, "":
+		return &roundRobinBalancer{}, nil
+	case BalanceRandom:
+		return randomBalancer{}, nil
+	case BalanceLeastConnections:
+		return leastConnectionsBalancer{}, nil
+	case BalanceWeighted:
+		return &weightedBalancer{currentWeights: make(map[*Target]int)}, nil
+	case BalanceHash:
+		return hashBalancer{}, nil
+	case BalanceFailover:
+		return &failoverBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown balance strategy: %s", strategy)
+	}
+}
+
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobinBalancer) Pick(candidates []*Target, clientAddr net.Addr) *Target {
+	return candidates[(b.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(candidates []*Target, clientAddr net.Addr) *Target {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+type leastConnectionsBalancer struct{}
+
+func (leastConnectionsBalancer) Pick(candidates []*Target, clientAddr net.Addr) *Target {
+	picked := candidates[0]
+	for _, target := range candidates[1:] {
+		if target.Active() < picked.Active() {
+			picked = target
+		}
+	}
+	return picked
+}
+
+// weightedBalancer is the smooth weighted round-robin of nginx, which spreads the picks of a heavy
+// target evenly instead of picking it several times in a row.
+type weightedBalancer struct {
+	mu             sync.Mutex
+	currentWeights map[*Target]int
+}
+
+func (b *weightedBalancer) Pick(candidates []*Target, clientAddr net.Addr) *Target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var picked *Target
+	totalWeight := 0
+	for _, target := range candidates {
+		b.currentWeights[target] += target.Weight
+		totalWeight += target.Weight
+		if picked == nil || b.currentWeights[target] > b.currentWeights[picked] {
+			picked = target
+		}
+	}
+	b.currentWeights[picked] -= totalWeight
+	return picked
+}
+
+// hashBalancer picks targets by rendezvous hashing on the client IP, so a client sticks to the same target,
+// and only clients of a target are moved when it's added or removed.
+type hashBalancer struct{}
+
+func (hashBalancer) Pick(candidates []*Target, clientAddr net.Addr) *Target {
+	var clientIp string
+	switch addr := clientAddr.(type) {
+	case *net.TCPAddr:
+		clientIp = addr.IP.String()
+	case *net.UDPAddr:
+		clientIp = addr.IP.String()
+	}
+
+	var picked *Target
+	var pickedScore uint64
+	for _, target := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(clientIp))
+		h.Write([]byte{0})
+		h.Write([]byte(target.URL))
+		if score := h.Sum64(); picked == nil || score > pickedScore {
+			picked, pickedScore = target, score
+		}
+	}
+	return picked
+}
+
+// failoverBalancer picks the first available target in the configured order, so the backups are only used
+// when the primary is unavailable and it fails back once the primary recovers.
+type failoverBalancer struct {
+	// The target of the last successful connection, nil before the first one.
+	current atomic.Pointer[Target]
+}
+
+func (b *failoverBalancer) Pick(candidates []*Target, clientAddr net.Addr) *Target {
+	return candidates[0]
+}
+
+// connected logs a failover or failback if target differs from the target of the last connection.
+func (b *failoverBalancer) connected(logger *Logger, targets []*Target, target *Target) {
+	previous := b.current.Swap(target)
+	if previous == nil {
+		previous = targets[0]
+	}
+	if previous == target {
+		return
+	}
+	if slices.Index(targets, target) > slices.Index(targets, previous) {
+		logger.Errorf("failed over from target %s to %s", previous.URL, target.URL)
+	} else {
+		logger.Infof("failed back from target %s to %s", previous.URL, target.URL)
+	}
+}
+
+// availableTargets returns the targets available for balancing. If none of them is, all targets are
+// returned since it's still better to try than fail everything.
+func availableTargets(targets []*Target) []*Target {
+	var available []*Target
+	for _, target := range targets {
+		if target.Available() {
+			available = append(available, target)
+		}
+	}
+	if len(available) == 0 {
+		return targets
+	}
+	return available
+}
+
+// Connect dials the target picked by the balancer for a connection from clientAddr, retrying with other
+// targets on failure. The target must be released after the returned connection is closed.
+func (s *Service) Connect(logger *Logger, clientAddr net.Addr) (net.Conn, *Target, error) {
+	return s.connectTo(logger, clientAddr, nil, s.Targets, s.Balancer, s.Retries)
+}
+
+// connectTo is Connect with the targets of a route instead of the service, sending the PROXY protocol header
+// if not nil.
+func (s *Service) connectTo(logger *Logger, clientAddr net.Addr, header []byte, targets []*Target, balancer Balancer, retries int) (net.Conn, *Target, error) {
+	tried := make(map[*Target]bool)
+	var target *Target
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		target = balancer.Pick(untriedTargets(availableTargets(targets), tried), clientAddr)
+		tried[target] = true
+
+		target.active.Add(1)
+		var conn net.Conn
+		start := time.Now()
+		// The timeout covers both connecting and the TLS handshake.
+		ctx, cancel := timeoutContext(s.Timeout)
+		conn, err = target.Dial(ctx, header)
+		cancel()
+		s.reportDialMetrics(target, time.Since(start), err)
+		s.reportDial(logger, target, err)
+		if err == nil {
+			if failover, ok := balancer.(*failoverBalancer); ok {
+				failover.connected(logger, targets, target)
+			}
+			return conn, target, nil
+		}
+		target.Release()
+
+		if attempt < retries {
+			logger.Verbosef("failed to connect to target %s, retrying: %v", target.URL, err)
+		}
+	}
+	return nil, target, err
+}
+
+// timeoutContext returns a context timing out after timeout, or never if it's zero, like net.DialTimeout.
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// untriedTargets returns the candidates not tried yet, preserving the order. Once all of them have been
+// tried, they're tried again from the start.
+func untriedTargets(candidates []*Target, tried map[*Target]bool) []*Target {
+	var untried []*Target
+	for _, target := range candidates {
+		if !tried[target] {
+			untried = append(untried, target)
+		}
+	}
+	if len(untried) == 0 {
+		clear(tried)
+		return candidates
+	}
+	return untried
+}
@@ -26,15 +26,138 @@ type TailscaleConfig struct {
 	Verbose   bool                  `yaml:"verbose,omitempty"`
 }
 
+// ConnectConfig is a connect target of a service.
+type ConnectConfig struct {
+	URL string `yaml:"url"`
+	// Only used by the "weighted" balance strategy. By default 1.
+	Weight int `yaml:"weight,omitempty"`
+}
+
+// UnmarshalYAML accepts either a URL or a mapping with the URL and options.
+func (c *ConnectConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.URL); err == nil {
+		return nil
+	}
+	type plain ConnectConfig
+	return unmarshal((*plain)(c))
+}
+
+type ConnectConfigs []ConnectConfig
+
+// UnmarshalYAML accepts either a single target or a list of targets.
+func (c *ConnectConfigs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single ConnectConfig
+	if err := unmarshal(&single); err == nil {
+		*c = ConnectConfigs{single}
+		return nil
+	}
+	var list []ConnectConfig
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*c = list
+	return nil
+}
+
+type HealthCheckConfig struct {
+	Type        HealthCheckType `yaml:"type,omitempty"`
+	RawInterval string          `yaml:"interval,omitempty"`
+	RawTimeout  string          `yaml:"timeout,omitempty"`
+	// Consecutive successes to become healthy and consecutive failures to become unhealthy.
+	Rise int `yaml:"rise,omitempty"`
+	Fall int `yaml:"fall,omitempty"`
+	// For HTTP checks.
+	Path         string `yaml:"path,omitempty"`
+	Host         string `yaml:"host,omitempty"`
+	ExpectStatus int    `yaml:"expectStatus,omitempty"`
+	// For send/expect checks.
+	Send   string `yaml:"send,omitempty"`
+	Expect string `yaml:"expect,omitempty"`
+
+	Interval time.Duration `yaml:"-"`
+	Timeout  time.Duration `yaml:"-"`
+}
+
+type OutlierDetectionConfig struct {
+	ConsecutiveFailures int    `yaml:"consecutiveFailures,omitempty"`
+	RawEjectionTime     string `yaml:"ejectionTime,omitempty"`
+
+	EjectionTime time.Duration `yaml:"-"`
+}
+
+// RouteConfig routes the HTTP requests (or connections) of a service in HTTP (or SNI or mux) mode to its own
+// connect targets.
+type RouteConfig struct {
+	// The Host of requests (or the server name of TLS connections), e.g. "app.example.com" or "*.example.com". Any
+	// host if empty.
+	Host string `yaml:"host,omitempty"`
+	// The path prefix of requests, matching whole segments. Any path if empty.
+	Path string `yaml:"path,omitempty"`
+	// Remove the path prefix from the requests forwarded to the targets.
+	StripPath bool `yaml:"stripPath,omitempty"`
+	// The protocol of connections in mux mode, one of "ssh", "tls", "http" and "proxy".
+	Protocol string `yaml:"protocol,omitempty"`
+	// Regular expression matching the first bytes of connections in mux mode.
+	Pattern string         `yaml:"pattern,omitempty"`
+	Connect ConnectConfigs `yaml:"connect"`
+}
+
+// TLSListenConfig is the certificate of a TLS listener, and how clients are authenticated.
+type TLSListenConfig struct {
+	// PEM files, fetched from Tailscale by default for Tailscale TLS listeners.
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+	// PEM file of the CAs to verify client certificates with. Client certificates are required if set.
+	ClientCA string `yaml:"clientCA,omitempty"`
+}
+
+// TLSConnectConfig is how TLS targets of a service are connected to.
+type TLSConnectConfig struct {
+	// The host of each target by default.
+	ServerName string `yaml:"serverName,omitempty"`
+	// PEM file of the CAs to verify the targets with, instead of the system CAs.
+	CA string `yaml:"ca,omitempty"`
+	// PEM files of the client certificate presented to the targets.
+	Cert               string   `yaml:"cert,omitempty"`
+	Key                string   `yaml:"key,omitempty"`
+	ALPN               []string `yaml:"alpn,omitempty"`
+	InsecureSkipVerify bool     `yaml:"insecureSkipVerify,omitempty"`
+}
+
 type ServiceConfig struct {
-	Listen        string `yaml:"listen"`
-	Connect       string `yaml:"connect"`
-	logLevel      string `yaml:"logLevel,omitempty"`
-	ProxyProtocol bool   `yaml:"proxyProtocol,omitempty"`
-	timeout       string `yaml:"timeout,omitempty"`
-
-	LogLevel LogLevel
-	Timeout  time.Duration
+	Listen                  string                  `yaml:"listen"`
+	Connect                 ConnectConfigs          `yaml:"connect"`
+	Mode                    ServiceMode             `yaml:"mode,omitempty"`
+	Routes                  []RouteConfig           `yaml:"routes,omitempty"`
+	Balance                 BalanceStrategy         `yaml:"balance,omitempty"`
+	Retries                 *int                    `yaml:"retries,omitempty"`
+	RawLogLevel             string                  `yaml:"logLevel,omitempty"`
+	ProxyProtocol           ProxyProtocolVersion    `yaml:"proxyProtocol,omitempty"`
+	ProxyProtocolAuthority  string                  `yaml:"proxyProtocolAuthority,omitempty"`
+	AcceptProxyProtocol     bool                    `yaml:"acceptProxyProtocol,omitempty"`
+	TrustedProxies          []string                `yaml:"trustedProxies,omitempty"`
+	RawProxyProtocolTimeout string                  `yaml:"proxyProtocolTimeout,omitempty"`
+	RawTimeout              string                  `yaml:"timeout,omitempty"`
+	RawSessionTimeout       string                  `yaml:"sessionTimeout,omitempty"`
+	RawSniffTimeout         string                  `yaml:"sniffTimeout,omitempty"`
+	RawIdleTimeout          string                  `yaml:"idleTimeout,omitempty"`
+	RawMaxLifetime          string                  `yaml:"maxLifetime,omitempty"`
+	Allow                   []string                `yaml:"allow,omitempty"`
+	Deny                    []string                `yaml:"deny,omitempty"`
+	HealthCheck             *HealthCheckConfig      `yaml:"healthCheck,omitempty"`
+	OutlierDetection        *OutlierDetectionConfig `yaml:"outlierDetection,omitempty"`
+	TLS                     *TLSListenConfig        `yaml:"tls,omitempty"`
+	ConnectTLS              *TLSConnectConfig       `yaml:"connectTls,omitempty"`
+
+	LogLevel             LogLevel      `yaml:"-"`
+	Timeout              time.Duration `yaml:"-"`
+	SessionTimeout       time.Duration `yaml:"-"`
+	SniffTimeout         time.Duration `yaml:"-"`
+	IdleTimeout          time.Duration `yaml:"-"`
+	MaxLifetime          time.Duration `yaml:"-"`
+	ProxyProtocolTimeout time.Duration `yaml:"-"`
+	// The groups of the global config, for ACL rules.
+	Groups map[string][]string `yaml:"-"`
 }
 
 func parseLogLevel(s string) (LogLevel, error) {
@@ -52,12 +175,30 @@ func parseLogLevel(s string) (LogLevel, error) {
 	}
 }
 
-type Config struct {
-	timeout   string                    `yaml:"timeout,omitempty"`
-	Tailscale TailscaleConfig           `yaml:"tailscale"`
-	Services  map[string]*ServiceConfig `yaml:"services"`
+type MetricsConfig struct {
+	// A TCP, UNIX socket or Tailscale listen URL to serve Prometheus metrics at /metrics.
+	Listen string `yaml:"listen,omitempty"`
+}
 
-	Timeout time.Duration
+type AdminConfig struct {
+	// A UNIX socket or loopback TCP listen URL to serve the admin API.
+	Listen string `yaml:"listen,omitempty"`
+}
+
+type Config struct {
+	RawTimeout      string                    `yaml:"timeout,omitempty"`
+	RawDrainTimeout string                    `yaml:"drainTimeout,omitempty"`
+	RawLogFormat    string                    `yaml:"logFormat,omitempty"`
+	Tailscale       TailscaleConfig           `yaml:"tailscale"`
+	Metrics         MetricsConfig             `yaml:"metrics,omitempty"`
+	Admin           AdminConfig               `yaml:"admin,omitempty"`
+	Services        map[string]*ServiceConfig `yaml:"services"`
+	// User logins of each group, to be used by ACL rules like "group:admins".
+	Groups map[string][]string `yaml:"groups,omitempty"`
+
+	Timeout      time.Duration `yaml:"-"`
+	DrainTimeout time.Duration `yaml:"-"`
+	LogFormat    LogFormat     `yaml:"-"`
 }
 
 type boolFlag struct {
@@ -82,6 +223,8 @@ func (f *boolFlag) String() string {
 type arguments struct {
 	conf           string
 	timeout        string
+	drainTimeout   string
+	logFormat      string
 	tsHostname     string
 	tsAuthKey      string
 	tsEphemeral    boolFlag
@@ -89,6 +232,8 @@ type arguments struct {
 	tsListenSocks5 string
 	tsListenHttp   string
 	tsVerbose      boolFlag
+	metricsListen  string
+	adminListen    string
 
 	services []string
 }
@@ -97,6 +242,8 @@ func parseArguments() *arguments {
 	flags := &arguments{}
 	flag.StringVar(&flags.conf, "conf", "", "YAML Configuration file")
 	flag.StringVar(&flags.timeout, "timeout", "", "Default connection timeout of services (and Tailscale proxies)")
+	flag.StringVar(&flags.drainTimeout, "drain-timeout", "", "Time to wait for connections to finish on shutdown before closing them (default 10s)")
+	flag.StringVar(&flags.logFormat, "log-format", "", "Log format, \"text\" or \"json\" (default \"text\")")
 	flag.StringVar(&flags.tsHostname, "ts-hostname", "", "Tailscale hostname")
 	flag.StringVar(&flags.tsAuthKey, "ts-authkey", "", "Tailscale authentication key (default to $TS_AUTHKEY)")
 	flag.Var(&flags.tsEphemeral, "ts-ephemeral", "Set the Tailscale host to ephemeral")
@@ -104,13 +251,20 @@ func parseArguments() *arguments {
 	flag.StringVar(&flags.tsListenSocks5, "ts-listen-socks5", "", "Start SOCKS5 proxy server on [host]:port to access Tailnet")
 	flag.StringVar(&flags.tsListenHttp, "ts-listen-http", "", "Start HTTP proxy server on [host]:port to access Tailnet")
 	flag.Var(&flags.tsVerbose, "ts-verbose", "Print Tailscale logs")
+	flag.StringVar(&flags.metricsListen, "metrics-listen", "", "Serve Prometheus metrics at /metrics on a TCP, UNIX socket or Tailscale listen URL")
+	flag.StringVar(&flags.adminListen, "admin-listen", "", "Serve the admin API on a UNIX socket or loopback TCP listen URL")
 	flag.Usage = func() {
 		f := flag.CommandLine.Output()
 		fmt.Fprintf(f, "Usage: %s [options] service1 service2 ...\n", os.Args[0])
-		fmt.Fprint(f, "\nTsukasa - A flexible port forwarder among TCP, UNIX Socket and Tailscale TCP ports.\n\n")
+		fmt.Fprintf(f, "       %s <command> [--admin address] [--conf file] [--json] [args]\n", os.Args[0])
+		fmt.Fprint(f, "\nTsukasa - A flexible port forwarder among TCP, UDP, UNIX Socket and Tailscale TCP/UDP ports.\n\n")
 		flag.PrintDefaults()
+		fmt.Fprint(f, "\nCommands talking to a running instance with the admin API:\n")
+		printCtlCommands(f)
 		fmt.Fprintf(f, "\nExample: %s \\\n", os.Args[0])
 		fmt.Fprintln(f, "    --timeout 10s \\")
+		fmt.Fprintln(f, "    --drain-timeout 30s \\")
+		fmt.Fprintln(f, "    --log-format json \\")
 		fmt.Fprintln(f, "    --ts-hostname Tsukasa \\")
 		fmt.Fprintln(f, "    --ts-authkey \"$TS_AUTHKEY\" \\")
 		fmt.Fprintln(f, "    --ts-ephemeral false \\")
@@ -118,8 +272,22 @@ func parseArguments() *arguments {
 		fmt.Fprintln(f, "    --ts-listen-socks5 127.0.0.1:1118 \\")
 		fmt.Fprintln(f, "    --ts-listen-http 127.0.0.1:8080 \\")
 		fmt.Fprintln(f, "    --ts-verbose true \\")
-		fmt.Fprintln(f, "    nginx,listen=tailscale://0.0.0.0:80,connect=tcp://127.0.0.1:8080,log-level=info,proxy-protocol \\")
-		fmt.Fprintln(f, "    myapp,listen=unix:/var/run/myapp.sock,connect=tailscale://app-hosted-in-tailnet:8080")
+		fmt.Fprintln(f, "    --metrics-listen tcp://127.0.0.1:9090 \\")
+		fmt.Fprintln(f, "    --admin-listen unix:/run/tsukasa.sock \\")
+		fmt.Fprintln(f, "    nginx,listen=tailscale://0.0.0.0:80,connect=tcp://127.0.0.1:8080,log-level=info,proxy-protocol,allow=tag:web,deny=user:eve@example.com \\")
+		fmt.Fprintln(f, "    myapp,listen=unix:/var/run/myapp.sock,connect=tailscale://app-hosted-in-tailnet:8080,proxy-protocol=v2 \\")
+		fmt.Fprintln(f, "    app,listen=tailscale://0.0.0.0:8080,connect=unix:/var/run/app.sock,connect=tailscale://standby-host:8080,balance=failover,eject-after=1 \\")
+		fmt.Fprintln(f, "    api,listen=tcp://127.0.0.1:8000,connect=tailscale://api-1:8000,connect=tailscale://api-2:8000,health-check=http,health-check-path=/healthz,eject-after=3 \\")
+		fmt.Fprintln(f, "    web,listen=tcp://0.0.0.0:443,connect=unix:/var/run/web.sock,accept-proxy-protocol,trusted-proxy=10.0.0.0/8,idle-timeout=10m,max-lifetime=24h \\")
+		fmt.Fprintln(f, "    dns,listen=udp://127.0.0.1:53,connect=udp://1.1.1.1:53,connect=udp://8.8.8.8:53,balance=hash,session-timeout=30s \\")
+		fmt.Fprintln(f, "    statsd,listen=tailscale-udp://0.0.0.0:8125,connect=udp://127.0.0.1:8125 \\")
+		fmt.Fprintln(f, "    https,listen=tailscale-tls://0.0.0.0:443,connect=unix:/var/run/app.sock \\")
+		fmt.Fprintln(f, "    apps,listen=tailscale-tls://0.0.0.0:4443,mode=http,route=grafana.example.com=tcp://127.0.0.1:3000,route=/api=unix:/var/run/api.sock,connect=tcp://127.0.0.1:8080 \\")
+		fmt.Fprintln(f, "    passthrough,listen=tailscale://0.0.0.0:5443,mode=sni,route=git.example.com=tcp://127.0.0.1:3443,route=*.dev.example.com=tcp://dev-host:443 \\")
+		fmt.Fprintln(f, "    gateway,listen=tailscale://0.0.0.0:6443,mode=mux,protocol-route=ssh=tcp://127.0.0.1:22,protocol-route=tls=tcp://127.0.0.1:8443,protocol-route=http=tcp://127.0.0.1:8080,sniff-timeout=1s \\")
+		fmt.Fprintln(f, "    public,listen=funnel://0.0.0.0:8443,connect=tcp://127.0.0.1:3000 \\")
+		fmt.Fprintln(f, "    secure,listen=tls://0.0.0.0:8443,connect=tcp://127.0.0.1:8080,tls-cert=/etc/tsukasa/cert.pem,tls-key=/etc/tsukasa/key.pem,tls-client-ca=/etc/tsukasa/client-ca.pem,allow=cert-subject:alice \\")
+		fmt.Fprintln(f, "    upstream,listen=unix:/var/run/upstream.sock,connect=tls://upstream.example.com:443,connect-tls-alpn=http/1.1")
 	}
 	flag.Parse()
 	flags.services = flag.Args()
@@ -130,8 +298,20 @@ var nameRegexp = regexp.MustCompile(`^[$a-zA-Z0-9_-]+$`)
 
 func parseService(s string) (name string, service *ServiceConfig, err error) {
 	// Examples:
-	// 		 nginx,listen=tailscale://0.0.0.0:80,connect=tcp://127.0.0.1:8080,log-level=info,proxy-protocol
-	// 		 myapp,listen=unix:/var/run/myapp.sock,connect=tailscale://app-hosted-in-tailnet:8080
+	// 		 nginx,listen=tailscale://0.0.0.0:80,connect=tcp://127.0.0.1:8080,log-level=info,proxy-protocol,allow=tag:web,deny=user:eve@example.com
+	// 		 myapp,listen=unix:/var/run/myapp.sock,connect=tailscale://app-hosted-in-tailnet:8080,proxy-protocol=v2
+	// 		 app,listen=tailscale://0.0.0.0:8080,connect=unix:/var/run/app.sock,connect=tailscale://standby-host:8080,balance=failover,eject-after=1
+	// 		 web,listen=tcp://0.0.0.0:443,connect=unix:/var/run/web.sock,accept-proxy-protocol,trusted-proxy=10.0.0.0/8,idle-timeout=10m,max-lifetime=24h
+	// 		 api,listen=tcp://127.0.0.1:8000,connect=tailscale://api-1:8000,connect=tailscale://api-2:8000,health-check=http,health-check-path=/healthz,eject-after=3
+	// 		 dns,listen=udp://127.0.0.1:53,connect=udp://1.1.1.1:53,connect=udp://8.8.8.8:53,balance=hash,session-timeout=30s
+	// 		 statsd,listen=tailscale-udp://0.0.0.0:8125,connect=udp://127.0.0.1:8125
+	// 		 https,listen=tailscale-tls://0.0.0.0:443,connect=unix:/var/run/app.sock
+	// 		 apps,listen=tailscale-tls://0.0.0.0:4443,mode=http,route=grafana.example.com=tcp://127.0.0.1:3000,route=/api=unix:/var/run/api.sock,connect=tcp://127.0.0.1:8080
+	// 		 passthrough,listen=tailscale://0.0.0.0:5443,mode=sni,route=git.example.com=tcp://127.0.0.1:3443,route=*.dev.example.com=tcp://dev-host:443
+	// 		 gateway,listen=tailscale://0.0.0.0:6443,mode=mux,protocol-route=ssh=tcp://127.0.0.1:22,protocol-route=tls=tcp://127.0.0.1:8443,protocol-route=http=tcp://127.0.0.1:8080,sniff-timeout=1s
+	// 		 public,listen=funnel://0.0.0.0:8443,connect=tcp://127.0.0.1:3000
+	// 		 secure,listen=tls://0.0.0.0:8443,connect=tcp://127.0.0.1:8080,tls-cert=/etc/tsukasa/cert.pem,tls-key=/etc/tsukasa/key.pem,tls-client-ca=/etc/tsukasa/client-ca.pem,allow=cert-subject:alice
+	// 		 upstream,listen=unix:/var/run/upstream.sock,connect=tls://upstream.example.com:443,connect-tls-alpn=http/1.1
 
 	// Split the string by commas
 	parts := strings.Split(s, ",")
@@ -165,22 +345,224 @@ func parseService(s string) (name string, service *ServiceConfig, err error) {
 			if value == nil {
 				return "", nil, fmt.Errorf("required value for option `connect`")
 			}
-			service.Connect = *value
+			service.Connect = append(service.Connect, ConnectConfig{URL: *value})
+		case "mode":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `mode`")
+			}
+			service.Mode = ServiceMode(*value)
+		case "route":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `route`")
+			}
+			route, err := parseRoute(*value)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid value for option `route`: %v", err)
+			}
+			service.Routes = append(service.Routes, *route)
+		case "protocol-route":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `protocol-route`")
+			}
+			protocol, url, found := strings.Cut(*value, "=")
+			if !found || url == "" {
+				return "", nil, fmt.Errorf("invalid value for option `protocol-route`: missing connect URL in route: %s", *value)
+			}
+			service.Routes = append(service.Routes, RouteConfig{Protocol: protocol, Connect: ConnectConfigs{{URL: url}}})
+		case "balance":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `balance`")
+			}
+			service.Balance = BalanceStrategy(*value)
+		case "health-check":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `health-check`")
+			}
+			if service.HealthCheck == nil {
+				service.HealthCheck = &HealthCheckConfig{}
+			}
+			service.HealthCheck.Type = HealthCheckType(*value)
+		case "health-check-interval":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `health-check-interval`")
+			}
+			if service.HealthCheck == nil {
+				service.HealthCheck = &HealthCheckConfig{}
+			}
+			service.HealthCheck.RawInterval = *value
+		case "health-check-path":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `health-check-path`")
+			}
+			if service.HealthCheck == nil {
+				service.HealthCheck = &HealthCheckConfig{}
+			}
+			service.HealthCheck.Path = *value
+		case "eject-after":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `eject-after`")
+			}
+			if service.OutlierDetection == nil {
+				service.OutlierDetection = &OutlierDetectionConfig{}
+			}
+			if service.OutlierDetection.ConsecutiveFailures, err = strconv.Atoi(*value); err != nil {
+				return "", nil, fmt.Errorf("invalid value for option `eject-after`: %v", err)
+			}
+		case "eject-time":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `eject-time`")
+			}
+			if service.OutlierDetection == nil {
+				service.OutlierDetection = &OutlierDetectionConfig{}
+			}
+			service.OutlierDetection.RawEjectionTime = *value
+		case "retries":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `retries`")
+			}
+			retries, err := strconv.Atoi(*value)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid value for option `retries`: %v", err)
+			}
+			service.Retries = &retries
 		case "log-level":
 			if value == nil {
 				return "", nil, fmt.Errorf("required value for option `log-level`")
 			}
-			service.logLevel = *value
+			service.RawLogLevel = *value
 		case "proxy-protocol":
+			if value == nil {
+				service.ProxyProtocol = ProxyProtocolV1
+			} else if service.ProxyProtocol, err = parseProxyProtocolVersion(*value); err != nil {
+				return "", nil, fmt.Errorf("invalid value for option `proxy-protocol`: %v", err)
+			}
+		case "proxy-protocol-authority":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `proxy-protocol-authority`")
+			}
+			service.ProxyProtocolAuthority = *value
+		case "accept-proxy-protocol":
 			if value != nil {
-				return "", nil, fmt.Errorf("no value expected for option `proxy-protocol`")
+				return "", nil, fmt.Errorf("no value expected for option `accept-proxy-protocol`")
+			}
+			service.AcceptProxyProtocol = true
+		case "trusted-proxy":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `trusted-proxy`")
 			}
-			service.ProxyProtocol = true
+			service.TrustedProxies = append(service.TrustedProxies, *value)
+		case "proxy-protocol-timeout":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `proxy-protocol-timeout`")
+			}
+			service.RawProxyProtocolTimeout = *value
+		case "allow":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `allow`")
+			}
+			service.Allow = append(service.Allow, *value)
+		case "deny":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `deny`")
+			}
+			service.Deny = append(service.Deny, *value)
 		case "timeout":
 			if value == nil {
 				return "", nil, fmt.Errorf("required value for option `timeout`")
 			}
-			service.timeout = *value
+			service.RawTimeout = *value
+		case "tls-cert":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `tls-cert`")
+			}
+			if service.TLS == nil {
+				service.TLS = &TLSListenConfig{}
+			}
+			service.TLS.Cert = *value
+		case "tls-key":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `tls-key`")
+			}
+			if service.TLS == nil {
+				service.TLS = &TLSListenConfig{}
+			}
+			service.TLS.Key = *value
+		case "tls-client-ca":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `tls-client-ca`")
+			}
+			if service.TLS == nil {
+				service.TLS = &TLSListenConfig{}
+			}
+			service.TLS.ClientCA = *value
+		case "connect-tls-server-name":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `connect-tls-server-name`")
+			}
+			if service.ConnectTLS == nil {
+				service.ConnectTLS = &TLSConnectConfig{}
+			}
+			service.ConnectTLS.ServerName = *value
+		case "connect-tls-ca":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `connect-tls-ca`")
+			}
+			if service.ConnectTLS == nil {
+				service.ConnectTLS = &TLSConnectConfig{}
+			}
+			service.ConnectTLS.CA = *value
+		case "connect-tls-cert":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `connect-tls-cert`")
+			}
+			if service.ConnectTLS == nil {
+				service.ConnectTLS = &TLSConnectConfig{}
+			}
+			service.ConnectTLS.Cert = *value
+		case "connect-tls-key":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `connect-tls-key`")
+			}
+			if service.ConnectTLS == nil {
+				service.ConnectTLS = &TLSConnectConfig{}
+			}
+			service.ConnectTLS.Key = *value
+		case "connect-tls-alpn":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `connect-tls-alpn`")
+			}
+			if service.ConnectTLS == nil {
+				service.ConnectTLS = &TLSConnectConfig{}
+			}
+			service.ConnectTLS.ALPN = append(service.ConnectTLS.ALPN, *value)
+		case "connect-tls-insecure":
+			if value != nil {
+				return "", nil, fmt.Errorf("no value expected for option `connect-tls-insecure`")
+			}
+			if service.ConnectTLS == nil {
+				service.ConnectTLS = &TLSConnectConfig{}
+			}
+			service.ConnectTLS.InsecureSkipVerify = true
+		case "session-timeout":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `session-timeout`")
+			}
+			service.RawSessionTimeout = *value
+		case "sniff-timeout":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `sniff-timeout`")
+			}
+			service.RawSniffTimeout = *value
+		case "idle-timeout":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `idle-timeout`")
+			}
+			service.RawIdleTimeout = *value
+		case "max-lifetime":
+			if value == nil {
+				return "", nil, fmt.Errorf("required value for option `max-lifetime`")
+			}
+			service.RawMaxLifetime = *value
 		default:
 			return "", nil, fmt.Errorf("unknown service argument: %s", key)
 		}
@@ -189,9 +571,32 @@ func parseService(s string) (name string, service *ServiceConfig, err error) {
 	return name, service, nil
 }
 
+// parseRoute parses a route option in the form of "[host][/path]=url", e.g. "app.example.com/api=tcp://127.0.0.1:8080".
+func parseRoute(s string) (*RouteConfig, error) {
+	match, url, found := strings.Cut(s, "=")
+	if !found || url == "" {
+		return nil, fmt.Errorf("missing connect URL in route: %s", s)
+	}
+	route := &RouteConfig{Connect: ConnectConfigs{{URL: url}}}
+	if i := strings.Index(match, "/"); i >= 0 {
+		route.Host, route.Path = match[:i], match[i:]
+	} else {
+		route.Host = match
+	}
+	return route, nil
+}
+
 func mergeConfig(c *Config, a *arguments) error {
 	if a.timeout != "" {
-		c.timeout = a.timeout
+		c.RawTimeout = a.timeout
+	}
+
+	if a.drainTimeout != "" {
+		c.RawDrainTimeout = a.drainTimeout
+	}
+
+	if a.logFormat != "" {
+		c.RawLogFormat = a.logFormat
 	}
 
 	if a.tsHostname != "" {
@@ -222,6 +627,14 @@ func mergeConfig(c *Config, a *arguments) error {
 		c.Tailscale.Verbose = a.tsVerbose.value
 	}
 
+	if a.metricsListen != "" {
+		c.Metrics.Listen = a.metricsListen
+	}
+
+	if a.adminListen != "" {
+		c.Admin.Listen = a.adminListen
+	}
+
 	for _, s := range a.services {
 		name, service, err := parseService(s)
 		if err != nil {
@@ -245,33 +658,114 @@ func (c *Config) ValidateTailscaleConfig() error {
 	return nil
 }
 
+// parseDuration parses a duration option, which is defaultValue if not specified.
+func parseDuration(s string, defaultValue time.Duration) (time.Duration, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(s)
+}
+
 func (c *Config) ProcessServices() error {
 	for name, service := range c.Services {
-		if service.Listen == "" {
-			return fmt.Errorf("missing listen address for service %s", name)
+		if err := c.ProcessService(name, service); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
 
-		if service.Connect == "" {
-			return fmt.Errorf("missing connect address for service %s", name)
+// ProcessService validates a service config and fills in its parsed fields, with the defaults of the global
+// config.
+func (c *Config) ProcessService(name string, service *ServiceConfig) error {
+	if service.Listen == "" {
+		return fmt.Errorf("missing listen address for service %s", name)
+	}
+
+	if len(service.Connect) == 0 && len(service.Routes) == 0 {
+		return fmt.Errorf("missing connect address for service %s", name)
+	}
+	for _, route := range service.Routes {
+		if len(route.Connect) == 0 {
+			return fmt.Errorf("missing connect address for a route of service %s", name)
 		}
+	}
 
-		if service.timeout == "" {
-			service.Timeout = c.Timeout
-		} else {
-			if timeout, err := time.ParseDuration(service.timeout); err != nil {
-				return fmt.Errorf("invalid timeout for service %s: %v", name, err)
-			} else {
-				service.Timeout = timeout
-			}
+	service.Groups = c.Groups
+
+	var err error
+	if service.LogLevel, err = parseLogLevel(service.RawLogLevel); err != nil {
+		return fmt.Errorf("invalid log level for service %s: %v", name, err)
+	}
+
+	if service.Timeout, err = parseDuration(service.RawTimeout, c.Timeout); err != nil {
+		return fmt.Errorf("invalid timeout for service %s: %v", name, err)
+	}
+
+	if service.SessionTimeout, err = parseDuration(service.RawSessionTimeout, defaultSessionTimeout); err != nil {
+		return fmt.Errorf("invalid session timeout for service %s: %v", name, err)
+	}
+	if service.SessionTimeout <= 0 {
+		return fmt.Errorf("non-positive session timeout for service %s", name)
+	}
+
+	if service.SniffTimeout, err = parseDuration(service.RawSniffTimeout, defaultSniffTimeout); err != nil {
+		return fmt.Errorf("invalid sniff timeout for service %s: %v", name, err)
+	}
+
+	if service.IdleTimeout, err = parseDuration(service.RawIdleTimeout, 0); err != nil {
+		return fmt.Errorf("invalid idle timeout for service %s: %v", name, err)
+	}
+	if service.IdleTimeout < 0 {
+		return fmt.Errorf("negative idle timeout for service %s", name)
+	}
+
+	if service.MaxLifetime, err = parseDuration(service.RawMaxLifetime, 0); err != nil {
+		return fmt.Errorf("invalid max lifetime for service %s: %v", name, err)
+	}
+	if service.MaxLifetime < 0 {
+		return fmt.Errorf("negative max lifetime for service %s", name)
+	}
+
+	if service.ProxyProtocolTimeout, err = parseDuration(service.RawProxyProtocolTimeout, defaultProxyProtocolTimeout); err != nil {
+		return fmt.Errorf("invalid PROXY protocol timeout for service %s: %v", name, err)
+	}
+
+	if healthCheck := service.HealthCheck; healthCheck != nil {
+		if healthCheck.Interval, err = parseDuration(healthCheck.RawInterval, defaultHealthCheckInterval); err != nil {
+			return fmt.Errorf("invalid health check interval for service %s: %v", name, err)
+		}
+		if healthCheck.Interval <= 0 {
+			return fmt.Errorf("non-positive health check interval for service %s", name)
+		}
+		if healthCheck.Timeout, err = parseDuration(healthCheck.RawTimeout, service.Timeout); err != nil {
+			return fmt.Errorf("invalid health check timeout for service %s: %v", name, err)
+		}
+		if healthCheck.Timeout <= 0 {
+			return fmt.Errorf("non-positive health check timeout for service %s", name)
+		}
+	}
+
+	if outlierDetection := service.OutlierDetection; outlierDetection != nil {
+		if outlierDetection.EjectionTime, err = parseDuration(outlierDetection.RawEjectionTime, defaultEjectionTime); err != nil {
+			return fmt.Errorf("invalid ejection time for service %s: %v", name, err)
 		}
 	}
 
 	return nil
 }
 
-func GetConfig() (*Config, error) {
+// GetConfig parses the command-line arguments and loads the config with them.
+func GetConfig() (*Config, *arguments, error) {
 	a := parseArguments()
+	c, err := LoadConfig(a)
+	return c, a, err
+}
 
+// LoadConfig loads the configuration file (if any) and merges the command-line arguments into it. It's also
+// used to reload the configuration file.
+func LoadConfig(a *arguments) (*Config, error) {
 	c := &Config{
 		Tailscale: TailscaleConfig{},
 		Services:  make(map[string]*ServiceConfig),
@@ -281,19 +775,23 @@ func GetConfig() (*Config, error) {
 		if err != nil {
 			return nil, err
 		}
+		defer f.Close()
 
 		err = yaml.NewDecoder(f).Decode(&c)
 		if err != nil {
 			return nil, err
 		}
+		if c.Services == nil {
+			c.Services = make(map[string]*ServiceConfig)
+		}
 	}
 
 	if err := mergeConfig(c, a); err != nil {
 		return nil, err
 	}
 
-	if c.timeout != "" {
-		if timeout, err := time.ParseDuration(c.timeout); err != nil {
+	if c.RawTimeout != "" {
+		if timeout, err := time.ParseDuration(c.RawTimeout); err != nil {
 			return nil, fmt.Errorf("invalid default timeout: %v", err)
 		} else {
 			c.Timeout = timeout
@@ -302,15 +800,17 @@ func GetConfig() (*Config, error) {
 		c.Timeout = 10 * time.Second
 	}
 
-	if c.Tailscale.AuthKey == "" {
-		c.Tailscale.AuthKey = os.Getenv("TS_AUTHKEY")
+	var err error
+	if c.DrainTimeout, err = parseDuration(c.RawDrainTimeout, defaultDrainTimeout); err != nil {
+		return nil, fmt.Errorf("invalid drain timeout: %v", err)
 	}
 
-	for name, service := range c.Services {
-		var err error
-		if service.LogLevel, err = parseLogLevel(service.logLevel); err != nil {
-			return nil, fmt.Errorf("invalid log level for service %s: %v", name, err)
-		}
+	if c.LogFormat, err = parseLogFormat(c.RawLogFormat); err != nil {
+		return nil, err
+	}
+
+	if c.Tailscale.AuthKey == "" {
+		c.Tailscale.AuthKey = os.Getenv("TS_AUTHKEY")
 	}
 
 	return c, nil
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDrainTimeout = 10 * time.Second
+
+// The reasons of connections (and datagram sessions) being closed, in the access log.
+const (
+	closeReasonClientClosed       = "client_closed"
+	closeReasonTargetClosed       = "target_closed"
+	closeReasonError              = "error"
+	closeReasonUntrustedProxy     = "untrusted_proxy"
+	closeReasonBadProxyHeader     = "bad_proxy_header"
+	closeReasonTLSHandshakeFailed = "tls_handshake_failed"
+	closeReasonDenied             = "denied"
+	closeReasonNoRoute            = "no_route"
+	closeReasonDialFailed         = "dial_failed"
+	closeReasonKilled             = "killed"
+	closeReasonShutdown           = "shutdown"
+	closeReasonIdle               = "idle"
+	closeReasonMaxLifetime        = "max_lifetime"
+	closeReasonServiceStopped     = "service_stopped"
+)
+
+// Connection is an accepted stream connection being forwarded by a service.
+type Connection struct {
+	ID        string
+	Service   string
+	StartTime time.Time
+	// Whether the connection is from the internet through Tailscale Funnel.
+	Funnel bool
+
+	// Bytes forwarded from the client to the target and back.
+	BytesIn  atomic.Int64
+	BytesOut atomic.Int64
+	// When the last bytes are forwarded in either direction, for the idle timeout.
+	lastActive atomic.Int64
+
+	// The fields below are set while handling the connection, so they're read by others with mu held.
+	mu sync.Mutex
+	// Replaced by the connection with the client address recovered from PROXY protocol, if accepted.
+	Conn net.Conn
+	// Identity of the tailnet peer, only available for connections accepted on Tailscale.
+	Identity *TailscaleIdentity
+	// State of the TLS connection terminated by a TLS listener, once handshaken.
+	TLS *tls.ConnectionState
+	// Client certificate verified by a TLS listener with client authentication.
+	Certificate *x509.Certificate
+	// Server name sent by the client in the TLS ClientHello, for TLS listeners and SNI mode.
+	ServerName string
+	// The route the connection is forwarded by, for SNI and mux modes.
+	Route      string
+	target     *Target
+	targetConn net.Conn
+	// Why the connection is closed by Close, empty if not.
+	closeReason string
+}
+
+// newConnectionID returns a random ID identifying a connection in logs and PROXY protocol headers, or a datagram
+// session in logs.
+func newConnectionID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func (c *Connection) Touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *Connection) LastActive() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+// watchTimeouts closes the connection once it has forwarded nothing for idleTimeout, or has lived for
+// maxLifetime, if they're not zero, until the returned function is called.
+func (c *Connection) watchTimeouts(idleTimeout, maxLifetime time.Duration) (stop func()) {
+	if idleTimeout == 0 && maxLifetime == 0 {
+		return func() {}
+	}
+	c.lastActive.Store(c.StartTime.UnixNano())
+
+	// The timers are only fired if their timeouts are set.
+	idleTimer := time.NewTimer(idleTimeout)
+	if idleTimeout == 0 {
+		idleTimer.Stop()
+	}
+	maxLifetimeTimer := time.NewTimer(maxLifetime)
+	if maxLifetime == 0 {
+		maxLifetimeTimer.Stop()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer idleTimer.Stop()
+		defer maxLifetimeTimer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-maxLifetimeTimer.C:
+				c.Close(closeReasonMaxLifetime)
+				return
+			case <-idleTimer.C:
+				idle := time.Since(c.LastActive())
+				if idle >= idleTimeout {
+					c.Close(closeReasonIdle)
+					return
+				}
+				idleTimer.Reset(idleTimeout - idle)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// Target returns the target the connection is forwarded to, nil if not connected yet.
+func (c *Connection) Target() *Target {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.target
+}
+
+// connected records the target of the connection. It returns false if the connection has been closed
+// meanwhile, in which case targetConn should be closed by the caller.
+func (c *Connection) connected(target *Target, targetConn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeReason != "" {
+		return false
+	}
+	c.target = target
+	c.targetConn = targetConn
+	return true
+}
+
+// Close closes the connection with the client and the target, which makes the forwarding finish. The reason
+// is reported in the access log.
+func (c *Connection) Close(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+	c.Conn.Close()
+	if c.targetConn != nil {
+		c.targetConn.Close()
+	}
+}
+
+// logAccess logs the access record of the finished connection, and returns the reason logged, which is
+// overridden if the connection is closed by Close.
+func (c *Connection) logAccess(logger *Logger, reason string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeReason != "" {
+		reason = c.closeReason
+	}
+
+	attrs := []slog.Attr{
+		slog.String("service", c.Service),
+		slog.String("id", c.ID),
+		slog.String("client", c.Conn.RemoteAddr().String()),
+	}
+	if c.Funnel {
+		attrs = append(attrs, slog.Bool("funnel", true))
+	}
+	if c.Identity != nil {
+		if c.Identity.UserLogin != "" {
+			attrs = append(attrs, slog.String("user", c.Identity.UserLogin))
+		}
+		attrs = append(attrs, slog.String("node", c.Identity.NodeName))
+		if len(c.Identity.Tags) > 0 {
+			attrs = append(attrs, slog.String("tags", strings.Join(c.Identity.Tags, ",")))
+		}
+	}
+	if c.Certificate != nil {
+		attrs = append(attrs, slog.String("cert", c.Certificate.Subject.String()))
+	}
+	if c.ServerName != "" {
+		attrs = append(attrs, slog.String("sni", c.ServerName))
+	}
+	if c.Route != "" {
+		attrs = append(attrs, slog.String("route", c.Route))
+	}
+	if c.target != nil {
+		attrs = append(attrs, slog.String("target", c.target.URL))
+	}
+	attrs = append(attrs,
+		slog.Int64("bytes_in", c.BytesIn.Load()),
+		slog.Int64("bytes_out", c.BytesOut.Load()),
+		slog.Float64("duration", time.Since(c.StartTime).Round(time.Microsecond).Seconds()),
+		slog.String("reason", reason),
+	)
+	logger.LogAttrs(Info, "connection closed", attrs...)
+	return reason
+}
+
+// trackConnection adds a connection to the live connections until the returned function is called.
+func (c *ServiceContext) trackConnection(conn *Connection) (untrack func()) {
+	c.connectionsMu.Lock()
+	defer c.connectionsMu.Unlock()
+	if c.connections == nil {
+		c.connections = make(map[string]*Connection)
+	}
+	c.connections[conn.ID] = conn
+	return func() {
+		c.connectionsMu.Lock()
+		defer c.connectionsMu.Unlock()
+		delete(c.connections, conn.ID)
+		if len(c.connections) == 0 && c.idleCh != nil {
+			close(c.idleCh)
+			c.idleCh = nil
+		}
+	}
+}
+
+// idle returns a channel closed once there are no live connections.
+func (c *ServiceContext) idle() <-chan struct{} {
+	c.connectionsMu.Lock()
+	defer c.connectionsMu.Unlock()
+	if len(c.connections) == 0 {
+		idleCh := make(chan struct{})
+		close(idleCh)
+		return idleCh
+	}
+	if c.idleCh == nil {
+		c.idleCh = make(chan struct{})
+	}
+	return c.idleCh
+}
+
+// Drain waits for the live connections to finish, after the services have stopped accepting new ones. The
+// connections left are closed after timeout, or once interrupted. UDP sessions are not waited for, since they're
+// closed by their services stopping.
+func (c *ServiceContext) Drain(timeout time.Duration, interrupt <-chan os.Signal) {
+	connections := c.Connections()
+	if len(connections) == 0 {
+		return
+	}
+
+	c.Metrics.Draining.With().Set(1)
+	defer c.Metrics.Draining.With().Set(0)
+	c.Logger.Infof("draining %d stream connections for up to %v, UDP sessions are closed", len(connections), timeout)
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.idle():
+		c.Logger.Infof("drained all connections in %v", time.Since(start).Round(time.Millisecond))
+		return
+	case <-timer.C:
+		connections = c.Connections()
+		c.Logger.Errorf("drain timeout exceeded, closing %d connections", len(connections))
+	case <-interrupt:
+		connections = c.Connections()
+		c.Logger.Errorf("drain interrupted, closing %d connections", len(connections))
+	}
+	c.Metrics.DrainClosedConnections.With().Add(int64(len(connections)))
+	for _, conn := range connections {
+		conn.Close(closeReasonShutdown)
+	}
+}
+
+// Connections returns the live connections of all services (including the stopped ones), oldest first.
+func (c *ServiceContext) Connections() []*Connection {
+	c.connectionsMu.Lock()
+	connections := make([]*Connection, 0, len(c.connections))
+	for _, conn := range c.connections {
+		connections = append(connections, conn)
+	}
+	c.connectionsMu.Unlock()
+	slices.SortFunc(connections, func(a, b *Connection) int {
+		if n := a.StartTime.Compare(b.StartTime); n != 0 {
+			return n
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return connections
+}
+
+// Connection returns the live connection with the ID, nil if not found.
+func (c *ServiceContext) Connection(id string) *Connection {
+	c.connectionsMu.Lock()
+	defer c.connectionsMu.Unlock()
+	return c.connections[id]
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The admin API address used by the commands if neither --admin nor --conf is specified.
+const defaultAdminAddress = "unix:/run/tsukasa.sock"
+
+// ctlCommand is a subcommand talking to a running instance with the admin API.
+type ctlCommand struct {
+	Name  string
+	Args  []string
+	Usage string
+	Run   func(client *ctlClient, args []string) error
+}
+
+var ctlCommands = []*ctlCommand{
+	{Name: "status", Usage: "Show the services", Run: ctlStatus},
+	{Name: "conns", Args: []string{"[service]"}, Usage: "Show the live connections, of all services or one", Run: ctlConns},
+	{Name: "kill", Args: []string{"<id>"}, Usage: "Kill a connection", Run: ctlKill},
+	{Name: "pause", Args: []string{"<service>"}, Usage: "Stop handling new connections of a service", Run: ctlPause},
+	{Name: "resume", Args: []string{"<service>"}, Usage: "Resume a paused service", Run: ctlResume},
+	{Name: "reload", Usage: "Reload the configuration file", Run: ctlReload},
+	{Name: "ts-status", Usage: "Show the status of the Tailscale node", Run: ctlTailscaleStatus},
+}
+
+func findCtlCommand(name string) *ctlCommand {
+	for _, command := range ctlCommands {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+func printCtlCommands(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, command := range ctlCommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", strings.Join(append([]string{command.Name}, command.Args...), " "), command.Usage)
+	}
+	tw.Flush()
+}
+
+// RunCtl runs a subcommand with the arguments after its name and returns the exit code.
+func RunCtl(command *ctlCommand, args []string) int {
+	flags := flag.NewFlagSet(command.Name, flag.ContinueOnError)
+	admin := flags.String("admin", "", fmt.Sprintf("Admin API address of the running instance, a UNIX socket or TCP listen URL (default from --conf or %q)", defaultAdminAddress))
+	conf := flags.String("conf", "", "YAML Configuration file of the running instance, to find the admin API address")
+	jsonOutput := flags.Bool("json", false, "Print the raw JSON responses")
+	flags.Usage = func() {
+		f := flags.Output()
+		fmt.Fprintf(f, "Usage: %s %s\n\n%s.\n\n", os.Args[0], strings.Join(append([]string{command.Name, "[options]"}, command.Args...), " "), command.Usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	minArgs, maxArgs := 0, len(command.Args)
+	for _, arg := range command.Args {
+		if strings.HasPrefix(arg, "<") {
+			minArgs++
+		}
+	}
+	if flags.NArg() < minArgs || flags.NArg() > maxArgs {
+		flags.Usage()
+		return 2
+	}
+
+	address := *admin
+	if address == "" && *conf != "" {
+		var err error
+		if address, err = adminAddressFromConfig(*conf); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read config: %v\n", err)
+			return 1
+		}
+	}
+	if address == "" {
+		address = defaultAdminAddress
+	}
+	client, err := newCtlClient(address, *jsonOutput)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := command.Run(client, flags.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func adminAddressFromConfig(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var c Config
+	if err := yaml.NewDecoder(f).Decode(&c); err != nil {
+		return "", err
+	}
+	if c.Admin.Listen == "" {
+		return "", fmt.Errorf("admin API not enabled in %s", filename)
+	}
+	return c.Admin.Listen, nil
+}
+
+type ctlClient struct {
+	address string
+	baseUrl string
+	client  *http.Client
+	// Print the responses as is instead of formatting them.
+	json bool
+}
+
+func newCtlClient(address string, jsonOutput bool) (*ctlClient, error) {
+	addressType, host, port, err := parseUrl(urlTypeListen, address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin API address: %v", err)
+	}
+	c := &ctlClient{
+		address: address,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		json:    jsonOutput,
+	}
+	switch addressType {
+	case AddressUNIXSocket:
+		c.baseUrl = "http://tsukasa"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", host)
+			},
+		}
+	case AddressTCP:
+		c.baseUrl = "http://" + net.JoinHostPort(host, fmt.Sprint(port))
+	default:
+		return nil, fmt.Errorf("invalid admin API address: only UNIX socket and TCP addresses allowed")
+	}
+	return c, nil
+}
+
+// do sends a request to the admin API and decodes the JSON response into out, if not nil. With --json, the
+// response is printed instead and done is true.
+func (c *ctlClient) do(method, path string, body []byte, out any) (done bool, err error) {
+	request, err := http.NewRequest(method, c.baseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to the admin API at %s (is Tsukasa running with --admin-listen?): %v", c.address, err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+
+	if response.StatusCode >= 400 {
+		var apiError struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiError) == nil && apiError.Error != "" {
+			return false, fmt.Errorf("%s", apiError.Error)
+		}
+		return false, fmt.Errorf("admin API responded with %s", response.Status)
+	}
+	if c.json && len(data) > 0 {
+		os.Stdout.Write(data)
+		return true, nil
+	}
+	if out != nil {
+		return false, json.Unmarshal(data, out)
+	}
+	return false, nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exp])
+}
+
+func ctlStatus(client *ctlClient, args []string) error {
+	var services []adminService
+	if done, err := client.do("GET", "/services", nil, &services); done || err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tLISTEN\tTARGETS\tCONNS")
+	for _, service := range services {
+		state := "running"
+		if service.Paused {
+			state = "paused"
+		}
+		var targets []string
+		for _, target := range service.Targets {
+			if target.Available {
+				targets = append(targets, target.URL)
+			} else {
+				targets = append(targets, target.URL+" (down)")
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", service.Name, state, service.Listen, strings.Join(targets, ", "), service.Connections)
+	}
+	return tw.Flush()
+}
+
+func ctlConns(client *ctlClient, args []string) error {
+	path := "/connections"
+	if len(args) > 0 {
+		path += "?service=" + url.QueryEscape(args[0])
+	}
+	var connections []adminConnection
+	if done, err := client.do("GET", path, nil, &connections); done || err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSERVICE\tCLIENT\tTARGET\tIN\tOUT\tAGE")
+	for _, c := range connections {
+		clientAddr := c.Client
+		if c.Identity != nil {
+			clientAddr += " (" + c.Identity.String() + ")"
+		} else if c.Certificate != "" {
+			clientAddr += " (" + c.Certificate + ")"
+		}
+		if c.Funnel {
+			clientAddr += " (funnel)"
+		}
+		target := c.Target
+		if target == "" {
+			target = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.Service, clientAddr, target, formatBytes(c.BytesIn), formatBytes(c.BytesOut), c.Age)
+	}
+	return tw.Flush()
+}
+
+func ctlKill(client *ctlClient, args []string) error {
+	if done, err := client.do("DELETE", "/connections/"+url.PathEscape(args[0]), nil, nil); done || err != nil {
+		return err
+	}
+	fmt.Printf("killed connection %s\n", args[0])
+	return nil
+}
+
+func ctlPause(client *ctlClient, args []string) error {
+	if done, err := client.do("POST", "/services/"+url.PathEscape(args[0])+"/pause", nil, nil); done || err != nil {
+		return err
+	}
+	fmt.Printf("paused service %s\n", args[0])
+	return nil
+}
+
+func ctlResume(client *ctlClient, args []string) error {
+	if done, err := client.do("POST", "/services/"+url.PathEscape(args[0])+"/resume", nil, nil); done || err != nil {
+		return err
+	}
+	fmt.Printf("resumed service %s\n", args[0])
+	return nil
+}
+
+func ctlReload(client *ctlClient, args []string) error {
+	if done, err := client.do("POST", "/reload", nil, nil); done || err != nil {
+		return err
+	}
+	fmt.Println("reloaded config")
+	return nil
+}
+
+// ctlTailscaleStatus prints the status of the Tailscale node like `tailscale status`.
+func ctlTailscaleStatus(client *ctlClient, args []string) error {
+	var status adminTailscaleStatus
+	if done, err := client.do("GET", "/tailscale/status", nil, &status); done || err != nil {
+		return err
+	}
+
+	if status.BackendState != "Running" {
+		fmt.Printf("Tailscale is %s\n", status.BackendState)
+		if status.AuthURL != "" {
+			fmt.Printf("Log in at: %s\n", status.AuthURL)
+		}
+	}
+	for _, message := range status.Health {
+		fmt.Printf("# Health check: %s\n", message)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	printPeer := func(peer adminTailscalePeer, self bool) {
+		ip := "-"
+		if len(peer.IPs) > 0 {
+			ip = peer.IPs[0]
+		}
+		owner := peer.UserLogin
+		if peer.IsTagged {
+			owner = "tagged-devices"
+		}
+		var state string
+		switch {
+		case self:
+			state = "-"
+		case peer.KeyExpired:
+			state = "expired"
+		case !peer.Online:
+			state = "offline"
+		case !peer.Active:
+			state = "idle"
+		case peer.CurAddr != "":
+			state = fmt.Sprintf("active; direct %s, tx %d rx %d", peer.CurAddr, peer.TxBytes, peer.RxBytes)
+		default:
+			state = fmt.Sprintf("active; relay %q, tx %d rx %d", peer.Relay, peer.TxBytes, peer.RxBytes)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", ip, peer.DNSName, owner, peer.OS, state)
+	}
+	if status.Self != nil {
+		printPeer(*status.Self, true)
+	}
+	for _, peer := range status.Peers {
+		printPeer(peer, false)
+	}
+	return tw.Flush()
+}
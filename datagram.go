@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Large enough for any UDP payload.
+	maxDatagramSize = 65535
+
+	defaultSessionTimeout = time.Minute
+	// The most datagrams from a client kept while connecting its session to the target. More are dropped, like
+	// by a full socket buffer.
+	maxPendingDatagrams = 64
+)
+
+// DatagramSession tracks the target connection of a single client address of a datagram service.
+type DatagramSession struct {
+	ID         string
+	ClientAddr net.Addr
+	StartTime  time.Time
+
+	// Bytes forwarded from the client to the target and back.
+	BytesIn  atomic.Int64
+	BytesOut atomic.Int64
+
+	lastActive atomic.Int64
+
+	// The fields below are set once connected to the target, which is done without blocking the datagrams of
+	// other clients.
+	mu         sync.Mutex
+	TargetConn net.Conn
+	Target     *Target
+	// Datagrams from the client received while connecting, sent once connected.
+	pending [][]byte
+}
+
+func (s *DatagramSession) Touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *DatagramSession) LastActive() time.Time {
+	return time.Unix(0, s.lastActive.Load())
+}
+
+// send sends a datagram from the client to the target, or keeps it until connected. It returns the bytes sent.
+func (s *DatagramSession) send(p []byte) (int, error) {
+	s.mu.Lock()
+	if s.TargetConn == nil {
+		if len(s.pending) < maxPendingDatagrams {
+			s.pending = append(s.pending, bytes.Clone(p))
+		}
+		s.mu.Unlock()
+		return 0, nil
+	}
+	targetConn := s.TargetConn
+	s.mu.Unlock()
+	return targetConn.Write(p)
+}
+
+// connected sets the target connection of the session, and sends the datagrams kept meanwhile to it. It returns
+// the bytes sent.
+func (s *DatagramSession) connected(targetConn net.Conn, target *Target) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.TargetConn = targetConn
+	s.Target = target
+	var sent int64
+	for _, p := range s.pending {
+		n, err := targetConn.Write(p)
+		sent += int64(n)
+		if err != nil {
+			return sent, err
+		}
+	}
+	s.pending = nil
+	return sent, nil
+}
+
+// close closes the target connection of the session, if connected.
+func (s *DatagramSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.TargetConn != nil {
+		s.TargetConn.Close()
+	}
+}
+
+// logAccess logs the access record of the finished session, like the one of a stream connection.
+func (s *DatagramSession) logAccess(logger *Logger, service string, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := []slog.Attr{
+		slog.String("service", service),
+		slog.String("id", s.ID),
+		slog.String("client", s.ClientAddr.String()),
+	}
+	if s.Target != nil {
+		attrs = append(attrs, slog.String("target", s.Target.URL))
+	}
+	attrs = append(attrs,
+		slog.Int64("bytes_in", s.BytesIn.Load()),
+		slog.Int64("bytes_out", s.BytesOut.Load()),
+		slog.Float64("duration", time.Since(s.StartTime).Round(time.Microsecond).Seconds()),
+		slog.String("reason", reason),
+	)
+	logger.LogAttrs(Info, "session closed", attrs...)
+}
+
+func (s *Service) serveDatagram(logger *Logger) {
+	packetConn, cleanup, err := s.ListenPacket()
+	s.listened(err)
+	if err != nil {
+		logger.Errorf("failed to create listener: %v", err)
+		return
+	}
+
+	logger.Infof("listening on %s", s.Config.Listen)
+
+	var sessionsMu sync.Mutex
+	sessions := make(map[string]*DatagramSession)
+
+	go func() {
+		<-s.stopCh
+		cleanup()
+		sessionsMu.Lock()
+		for _, session := range sessions {
+			session.close()
+		}
+		sessionsMu.Unlock()
+	}()
+
+	// connect connects a new session to the target, then forwards the datagrams replied until it ends.
+	connect := func(key string, session *DatagramSession) {
+		removeSession := func() {
+			sessionsMu.Lock()
+			if sessions[key] == session {
+				delete(sessions, key)
+			}
+			sessionsMu.Unlock()
+		}
+
+		closed := s.metrics.connectionStarted()
+		targetConn, target, err := s.Connect(logger, session.ClientAddr)
+		if err != nil {
+			if target != nil {
+				logger.Errorf("failed to connect to target %s: %v", target.URL, err)
+			} else {
+				logger.Errorf("failed to connect to a target: %v", err)
+			}
+			closed(closeReasonDialFailed)
+			removeSession()
+			session.logAccess(logger, s.Name, closeReasonDialFailed)
+			return
+		}
+		logger.Verbosef("created session %s for %v to target %s (%v)", session.ID, session.ClientAddr, target.URL, targetConn.RemoteAddr())
+
+		// Sessions connected after the service stops are not closed by it.
+		sessionsMu.Lock()
+		select {
+		case <-s.stopCh:
+			targetConn.Close()
+		default:
+		}
+		n, err := session.connected(targetConn, target)
+		sessionsMu.Unlock()
+		session.BytesIn.Add(n)
+		s.metrics.bytesIn.Add(n)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Errorf("error sending datagram to target: %v", err)
+		}
+
+		reason := PipeDatagrams(packetConn, session, s.SessionTimeout, logger, func(n int64) {
+			session.BytesOut.Add(n)
+			s.metrics.bytesOut.Add(n)
+		})
+		target.Release()
+		closed(reason)
+		removeSession()
+		session.logAccess(logger, s.Name, reason)
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		if !s.waitResumed() {
+			logger.Infof("stopped listening on %s", s.Config.Listen)
+			return
+		}
+		n, clientAddr, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.stopCh:
+				logger.Infof("stopped listening on %s", s.Config.Listen)
+				return
+			default:
+				logger.Errorf("failed to receive datagram: %v", err)
+				continue
+			}
+		}
+
+		key := clientAddr.String()
+		sessionsMu.Lock()
+		session := sessions[key]
+		if session == nil {
+			session = &DatagramSession{
+				ID:         newConnectionID(),
+				ClientAddr: clientAddr,
+				StartTime:  time.Now(),
+			}
+			// Active from the start, so that the session doesn't look idle before its first datagram is sent.
+			session.Touch()
+			sessions[key] = session
+			go connect(key, session)
+		}
+		sessionsMu.Unlock()
+
+		session.Touch()
+		if sent, err := session.send(buf[:n]); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Errorf("error sending datagram to target: %v", err)
+		} else if err == nil {
+			session.BytesIn.Add(int64(sent))
+			s.metrics.bytesIn.Add(int64(sent))
+		}
+	}
+}
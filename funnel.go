@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// The ports Tailscale Funnel is available on.
+var funnelPorts = []int16{443, 8443, 10000}
+
+// funnelConn is a connection from the internet through Tailscale Funnel. Its remote address is the one of the
+// client, instead of the Funnel relay.
+type funnelConn struct {
+	net.Conn
+	src netip.AddrPort
+}
+
+func (c *funnelConn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.src)
+}
+
+// NetConn returns the underlying connection.
+func (c *funnelConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// funnelListener unwraps the connections accepted by a Funnel listener of tsnet, which are wrapped in TLS
+// servers, so the TLS handshake is left to the service like other TLS listeners.
+type funnelListener struct {
+	net.Listener
+}
+
+func (l *funnelListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if funnel, ok := conn.(*ipn.FunnelConn); ok {
+		return &funnelConn{Conn: funnel.Conn, src: funnel.Src}, nil
+	}
+	return conn, nil
+}
+
+// listenFunnel listens on a port of both the tailnet and the internet through Tailscale Funnel. Funnel is
+// allowed on the port in the serve config of the node until cleaned up.
+func (c *ServiceContext) listenFunnel(port int16) (listener net.Listener, cleanup func(), err error) {
+	if listener, err = c.TsNet.ListenFunnel("tcp", ":"+strconv.Itoa(int(port))); err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() {
+		listener.Close()
+		c.disallowFunnel(port)
+	}
+	return &funnelListener{listener}, cleanup, nil
+}
+
+// disallowFunnel removes a port allowed by listenFunnel from the serve config of the node, so it's not left
+// public after the service is stopped.
+func (c *ServiceContext) disallowFunnel(port int16) {
+	domains := c.TsNet.CertDomains()
+	if len(domains) == 0 {
+		return
+	}
+	localClient, err := c.TsNet.LocalClient()
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	serveConfig, err := localClient.GetServeConfig(ctx)
+	hostPort := ipn.HostPort(net.JoinHostPort(domains[0], strconv.Itoa(int(port))))
+	if err != nil || serveConfig == nil || !serveConfig.AllowFunnel[hostPort] {
+		return
+	}
+	delete(serveConfig.AllowFunnel, hostPort)
+	if err := localClient.SetServeConfig(ctx, serveConfig); err != nil {
+		c.Logger.Errorf("failed to disallow Funnel on port %d: %v", port, err)
+	}
+}
@@ -2,7 +2,11 @@ module github.com/Menci/tsukasa
 
 go 1.22.5
 
-require gopkg.in/yaml.v2 v2.4.0
+require (
+	golang.org/x/sys v0.21.0
+	gopkg.in/yaml.v2 v2.4.0
+	tailscale.com v1.70.0
+)
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
@@ -76,7 +80,6 @@ require (
 	golang.org/x/mod v0.18.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
-	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/term v0.21.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
@@ -85,5 +88,4 @@ require (
 	golang.zx2c4.com/wireguard/windows v0.5.3 // indirect
 	gvisor.dev/gvisor v0.0.0-20240306221502-ee1e1f6070e3 // indirect
 	nhooyr.io/websocket v1.8.10 // indirect
-	tailscale.com v1.70.0 // indirect
 )
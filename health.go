@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+
+	defaultConsecutiveFailures = 3
+	defaultEjectionTime        = 30 * time.Second
+
+	// The maximum number of bytes read from the target of a send/expect check.
+	maxExpectLength = 4096
+)
+
+type HealthCheckType string
+
+const (
+	HealthCheckConnect    HealthCheckType = "connect"
+	HealthCheckHTTP       HealthCheckType = "http"
+	HealthCheckSendExpect HealthCheckType = "send-expect"
+)
+
+// HealthCheck periodically checks each target of a service, taking unhealthy ones out of balancing.
+type HealthCheck struct {
+	Type     HealthCheckType
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+
+	Path         string
+	Host         string
+	ExpectStatus int
+
+	Send   []byte
+	Expect []byte
+}
+
+func CreateHealthCheck(config *HealthCheckConfig, datagram bool) (*HealthCheck, error) {
+	healthCheck := &HealthCheck{
+		Type:         config.Type,
+		Interval:     config.Interval,
+		Timeout:      config.Timeout,
+		Rise:         config.Rise,
+		Fall:         config.Fall,
+		Path:         config.Path,
+		Host:         config.Host,
+		ExpectStatus: config.ExpectStatus,
+		Send:         []byte(config.Send),
+		Expect:       []byte(config.Expect),
+	}
+	if healthCheck.Type == "" {
+		healthCheck.Type = HealthCheckConnect
+	}
+	if healthCheck.Rise <= 0 {
+		healthCheck.Rise = defaultHealthCheckRise
+	}
+	if healthCheck.Fall <= 0 {
+		healthCheck.Fall = defaultHealthCheckFall
+	}
+	if healthCheck.Path == "" {
+		healthCheck.Path = "/"
+	}
+
+	switch healthCheck.Type {
+	case HealthCheckConnect, HealthCheckHTTP:
+		if datagram {
+			return nil, fmt.Errorf("%s health check is not supported for datagram targets", healthCheck.Type)
+		}
+	case HealthCheckSendExpect:
+		if len(healthCheck.Send) == 0 && datagram {
+			return nil, fmt.Errorf("send/expect health check of datagram targets requires something to send")
+		}
+	default:
+		return nil, fmt.Errorf("unknown health check type: %s", healthCheck.Type)
+	}
+	return healthCheck, nil
+}
+
+// Check checks the target once, within the timeout of the check.
+func (h *HealthCheck) Check(target *Target) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	switch h.Type {
+	case HealthCheckConnect:
+		conn, err := target.Dial(ctx, nil)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case HealthCheckHTTP:
+		return h.checkHTTP(ctx, target)
+	case HealthCheckSendExpect:
+		return h.checkSendExpect(ctx, target)
+	default:
+		return fmt.Errorf("unknown health check type: %s", h.Type)
+	}
+}
+
+func (h *HealthCheck) checkHTTP(ctx context.Context, target *Target) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return target.Dial(ctx, nil)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	host := h.Host
+	if host == "" {
+		host = "localhost"
+		if target.Type != AddressUNIXSocket {
+			host = target.Address
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+h.Path, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, maxExpectLength))
+
+	if h.ExpectStatus != 0 && response.StatusCode != h.ExpectStatus {
+		return fmt.Errorf("unexpected HTTP status %d", response.StatusCode)
+	} else if h.ExpectStatus == 0 && (response.StatusCode < 200 || response.StatusCode >= 400) {
+		return fmt.Errorf("unexpected HTTP status %d", response.StatusCode)
+	}
+	return nil
+}
+
+func (h *HealthCheck) checkSendExpect(ctx context.Context, target *Target) error {
+	conn, err := target.Dial(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if len(h.Send) > 0 {
+		if _, err := conn.Write(h.Send); err != nil {
+			return err
+		}
+	}
+	if len(h.Expect) == 0 {
+		return nil
+	}
+
+	var received []byte
+	buf := make([]byte, maxExpectLength)
+	for len(received) < maxExpectLength {
+		n, err := conn.Read(buf)
+		received = append(received, buf[:n]...)
+		if bytes.Contains(received, h.Expect) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("expected response not received: %v", err)
+		}
+	}
+	return fmt.Errorf("expected response not received")
+}
+
+func (s *Service) startHealthChecks(logger *Logger) {
+	if s.HealthCheck == nil {
+		return
+	}
+	for _, target := range s.Targets {
+		go s.runHealthCheck(logger, target)
+	}
+}
+
+func (s *Service) runHealthCheck(logger *Logger, target *Target) {
+	ticker := time.NewTicker(s.HealthCheck.Interval)
+	defer ticker.Stop()
+
+	successes, failures := 0, 0
+	for {
+		if err := s.HealthCheck.Check(target); err != nil {
+			successes, failures = 0, failures+1
+			if failures == s.HealthCheck.Fall && !target.unhealthy.Swap(true) {
+				logger.Errorf("target %s is unhealthy: %v", target.URL, err)
+			} else {
+				logger.Verbosef("health check of target %s failed: %v", target.URL, err)
+			}
+		} else {
+			successes, failures = successes+1, 0
+			if successes == s.HealthCheck.Rise && target.unhealthy.Swap(false) {
+				logger.Infof("target %s is healthy again", target.URL)
+			}
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// OutlierDetection ejects a target from balancing for a while after consecutive failures to connect to it.
+type OutlierDetection struct {
+	ConsecutiveFailures int
+	EjectionTime        time.Duration
+}
+
+func CreateOutlierDetection(config *OutlierDetectionConfig) *OutlierDetection {
+	outlierDetection := &OutlierDetection{
+		ConsecutiveFailures: config.ConsecutiveFailures,
+		EjectionTime:        config.EjectionTime,
+	}
+	if outlierDetection.ConsecutiveFailures <= 0 {
+		outlierDetection.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	return outlierDetection
+}
+
+// reportDial feeds the result of connecting to a target to the outlier detection.
+func (s *Service) reportDial(logger *Logger, target *Target, err error) {
+	if s.OutlierDetection == nil {
+		return
+	}
+	if err == nil {
+		target.consecutiveFailures.Store(0)
+		return
+	}
+	// Failures are not reset on ejection, so a target still failing after the ejection is ejected again at once.
+	failures := target.consecutiveFailures.Add(1)
+	now := time.Now()
+	if failures >= int64(s.OutlierDetection.ConsecutiveFailures) && now.UnixNano() >= target.ejectedUntil.Load() {
+		target.ejectedUntil.Store(now.Add(s.OutlierDetection.EjectionTime).UnixNano())
+		logger.Errorf("target %s ejected for %v after %d consecutive failures", target.URL, s.OutlierDetection.EjectionTime, s.OutlierDetection.ConsecutiveFailures)
+	}
+}
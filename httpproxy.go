@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpRequest is the state of a request being forwarded, passed to the dialing of the transport.
+type httpRequest struct {
+	route *Route
+	// Set by the dialing, which may finish after the request is canceled.
+	target atomic.Pointer[Target]
+	status int
+}
+
+type httpRequestKey struct{}
+
+// singleConnListener accepts a single connection, then blocks until it's closed, or the listener is closed by
+// the server shutting down.
+type singleConnListener struct {
+	conn      net.Conn
+	accepted  bool
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	select {
+	case <-l.closed:
+	case <-l.done:
+	}
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// httpConn is an accepted connection served by the HTTP server, reporting the bytes from and to the client,
+// and when it's closed (including after being hijacked for a protocol upgrade).
+type httpConn struct {
+	net.Conn
+	countIn   func(n int64)
+	countOut  func(n int64)
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *httpConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.countIn(int64(n))
+	return n, err
+}
+
+func (c *httpConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.countOut(int64(n))
+	return n, err
+}
+
+func (c *httpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// releasingConn releases the target once the connection to it is closed.
+type releasingConn struct {
+	net.Conn
+	target      *Target
+	releaseOnce sync.Once
+}
+
+func (c *releasingConn) Close() error {
+	c.releaseOnce.Do(c.target.Release)
+	return c.Conn.Close()
+}
+
+// serveHTTP serves the HTTP requests of a connection, forwarding them to the targets of the matching routes.
+// Upgraded connections (e.g. WebSocket) are forwarded as is after the upgrade. It returns once the
+// connection is closed.
+func (s *Service) serveHTTP(logger *Logger, c *Connection) string {
+	conn := &httpConn{
+		Conn: c.Conn,
+		countIn: func(n int64) {
+			c.BytesIn.Add(n)
+			c.Touch()
+			s.metrics.bytesIn.Add(n)
+		},
+		countOut: func(n int64) {
+			c.BytesOut.Add(n)
+			c.Touch()
+			s.metrics.bytesOut.Add(n)
+		},
+		closed: make(chan struct{}),
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			request := ctx.Value(httpRequestKey{}).(*httpRequest)
+			var header []byte
+			if s.ConnectProxyProtocol != ProxyProtocolNone {
+				var err error
+				if header, err = s.proxyProtocolHeader(c).Encode(s.ConnectProxyProtocol); err != nil {
+					return nil, fmt.Errorf("failed to encode PROXY protocol header: %v", err)
+				}
+			}
+			targetConn, target, err := s.connectTo(logger, c.Conn.RemoteAddr(), header, request.route.Targets, request.route.Balancer, request.route.Retries)
+			request.target.Store(target)
+			if err != nil {
+				return nil, err
+			}
+			return &releasingConn{Conn: targetConn, target: target}, nil
+		},
+		// Every request is balanced and dialed on its own, like connections in the forward mode.
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			request := r.In.Context().Value(httpRequestKey{}).(*httpRequest)
+			// The URL only tells the transport to speak HTTP, the target is picked when dialing.
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.Host
+			r.Out.Host = r.In.Host
+			if request.route.StripPath {
+				r.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.In.URL.Path, request.route.Path), "/")
+				r.Out.URL.RawPath = ""
+			}
+			r.SetXForwarded()
+			// The server doesn't see the TLS of the listener, which is terminated before.
+			if s.ListenType.IsTLS() {
+				r.Out.Header.Set("X-Forwarded-Proto", "https")
+			}
+			setClientHeaders(r.Out.Header, c)
+		},
+		Transport: transport,
+		ModifyResponse: func(response *http.Response) error {
+			response.Request.Context().Value(httpRequestKey{}).(*httpRequest).status = response.StatusCode
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			request := r.Context().Value(httpRequestKey{}).(*httpRequest)
+			if errors.Is(err, context.Canceled) {
+				// The client is gone.
+				request.status = 499
+				return
+			}
+			logger.Errorf("failed to forward request %s %s of connection %s: %v", r.Method, r.URL.Path, c.ID, err)
+			request.status = http.StatusBadGateway
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		ErrorLog: logger.StandardLogger(Verbose),
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			request := &httpRequest{route: s.matchRoute(r.Host, r.URL.Path)}
+			if request.route == nil {
+				request.status = http.StatusNotFound
+				http.NotFound(w, r)
+			} else {
+				proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), httpRequestKey{}, request)))
+			}
+			s.logRequest(logger, c, r, request, time.Since(start))
+		}),
+		ReadHeaderTimeout: s.Timeout,
+		ErrorLog:          logger.StandardLogger(Verbose),
+	}
+	// Once the service stops, e.g. on shutdown before draining, the connection is closed as soon as no request
+	// is being served, instead of being kept alive for more.
+	var stopped atomic.Bool
+	go func() {
+		select {
+		case <-s.stopCh:
+			stopped.Store(true)
+			server.Shutdown(context.Background())
+		case <-conn.closed:
+		}
+	}()
+	listener := &singleConnListener{conn: conn, closed: conn.closed, done: make(chan struct{})}
+	server.Serve(listener)
+	if listener.accepted {
+		// Served until closed, after Serve returns on shutdown.
+		<-conn.closed
+	} else {
+		// Not served at all if the service has stopped meanwhile.
+		conn.Close()
+	}
+	if stopped.Load() {
+		return closeReasonServiceStopped
+	}
+	return closeReasonClientClosed
+}
+
+// setClientHeaders sets the headers telling the server who the client is, by the Tailscale identity and the
+// client certificate of the connection, replacing those sent by the client.
+func setClientHeaders(header http.Header, c *Connection) {
+	for key := range header {
+		if strings.HasPrefix(key, "Tailscale-") || strings.HasPrefix(key, "X-Client-Cert-") {
+			header.Del(key)
+		}
+	}
+	if c.Identity != nil {
+		if c.Identity.UserLogin != "" {
+			header.Set("Tailscale-User-Login", c.Identity.UserLogin)
+		}
+		header.Set("Tailscale-Node-Name", c.Identity.NodeName)
+		if len(c.Identity.Tags) > 0 {
+			header.Set("Tailscale-Node-Tags", strings.Join(c.Identity.Tags, ","))
+		}
+	}
+	if c.Certificate != nil {
+		header.Set("X-Client-Cert-Subject", c.Certificate.Subject.String())
+		if sans := certificateSANs(c.Certificate); len(sans) > 0 {
+			header.Set("X-Client-Cert-Sans", strings.Join(sans, ","))
+		}
+	}
+}
+
+// logRequest logs the access record of a request forwarded by an HTTP service.
+func (s *Service) logRequest(logger *Logger, c *Connection, r *http.Request, request *httpRequest, duration time.Duration) {
+	attrs := []slog.Attr{
+		slog.String("service", s.Name),
+		slog.String("id", c.ID),
+		slog.String("client", c.Conn.RemoteAddr().String()),
+		slog.String("method", r.Method),
+		slog.String("host", r.Host),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", request.status),
+	}
+	if request.route != nil {
+		attrs = append(attrs, slog.String("route", request.route.String()))
+	}
+	if target := request.target.Load(); target != nil {
+		attrs = append(attrs, slog.String("target", target.URL))
+	}
+	attrs = append(attrs, slog.Float64("duration", duration.Round(time.Microsecond).Seconds()))
+	logger.LogAttrs(Info, "request", attrs...)
+}
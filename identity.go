@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"tailscale.com/client/tailscale"
+)
+
+// Custom PROXY protocol v2 TLV types (in the range reserved for applications) carrying the identity of
+// the Tailscale peer.
+const (
+	ProxyTLVTailscaleUserLogin byte = 0xE0
+	ProxyTLVTailscaleNodeName  byte = 0xE1
+	ProxyTLVTailscaleTags      byte = 0xE2
+)
+
+// TailscaleIdentity is the identity of the tailnet peer of a connection.
+type TailscaleIdentity struct {
+	// Empty for tagged nodes, which are not owned by a user.
+	UserLogin string `json:"userLogin,omitempty"`
+	// The MagicDNS name without the trailing dot.
+	NodeName string   `json:"nodeName"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+func (i *TailscaleIdentity) String() string {
+	if i.UserLogin != "" {
+		return fmt.Sprintf("%s on %s", i.UserLogin, i.NodeName)
+	}
+	return fmt.Sprintf("%s (%s)", i.NodeName, strings.Join(i.Tags, ","))
+}
+
+// ProxyTLVs returns the TLVs to pass the identity to the target with PROXY protocol v2.
+func (i *TailscaleIdentity) ProxyTLVs() []ProxyTLV {
+	tlvs := []ProxyTLV{{Type: ProxyTLVTailscaleNodeName, Value: []byte(i.NodeName)}}
+	if i.UserLogin != "" {
+		tlvs = append(tlvs, ProxyTLV{Type: ProxyTLVTailscaleUserLogin, Value: []byte(i.UserLogin)})
+	}
+	if len(i.Tags) > 0 {
+		tlvs = append(tlvs, ProxyTLV{Type: ProxyTLVTailscaleTags, Value: []byte(strings.Join(i.Tags, ","))})
+	}
+	return tlvs
+}
+
+// WhoIs looks up the tailnet identity of the peer at addr. It returns nil without error if addr is not
+// a tailnet peer, e.g. a client address recovered from PROXY protocol.
+func (c *ServiceContext) WhoIs(ctx context.Context, addr net.Addr) (*TailscaleIdentity, error) {
+	localClient, err := c.TsNet.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	whoIs, err := localClient.WhoIs(ctx, addr.String())
+	if errors.Is(err, tailscale.ErrPeerNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	identity := &TailscaleIdentity{
+		NodeName: strings.TrimSuffix(whoIs.Node.Name, "."),
+		Tags:     whoIs.Node.Tags,
+	}
+	if !whoIs.Node.IsTagged() && whoIs.UserProfile != nil {
+		identity.UserLogin = whoIs.UserProfile.LoginName
+	}
+	return identity, nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type LogLevel int
@@ -14,19 +18,74 @@ const (
 	Verbose LogLevel = 2
 )
 
+func (l LogLevel) String() string {
+	switch l {
+	case Error:
+		return "error"
+	case Info:
+		return "info"
+	case Verbose:
+		return "verbose"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+}
+
+func (l LogLevel) slogLevel() slog.Level {
+	switch l {
+	case Error:
+		return slog.LevelError
+	case Info:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
+
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+func parseLogFormat(s string) (LogFormat, error) {
+	switch LogFormat(s) {
+	case LogFormatText, "":
+		return LogFormatText, nil
+	case LogFormatJSON:
+		return LogFormatJSON, nil
+	default:
+		return "", fmt.Errorf("unknown log format: %s", s)
+	}
+}
+
+// The format of all loggers, set once the config is loaded. Logs before that are always text.
+var logFormat = LogFormatText
+
+// All JSON loggers share the handler so that records are written one at a time.
+var jsonHandler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+func SetLogFormat(format LogFormat) {
+	logFormat = format
+}
+
 type Logger struct {
-	Printf   func(format string, v ...interface{})
+	Prefix   string
 	LogLevel LogLevel
+
+	text *log.Logger
+	json *slog.Logger
 }
 
 func (l *Logger) Fatalf(format string, v ...interface{}) {
-	l.Printf(format, v...)
+	l.output(Error, fmt.Sprintf(format, v...), nil)
 	os.Exit(1)
 }
 
 func (l *Logger) Logf(logLevel LogLevel, format string, v ...interface{}) {
 	if l.LogLevel >= logLevel {
-		l.Printf(format, v...)
+		l.output(logLevel, fmt.Sprintf(format, v...), nil)
 	}
 }
 
@@ -42,9 +101,60 @@ func (l *Logger) Verbosef(format string, v ...interface{}) {
 	l.Logf(Verbose, format, v...)
 }
 
+// LogAttrs logs a message with attributes, which are fields of the record in JSON, or key=value pairs
+// following the message in text.
+func (l *Logger) LogAttrs(logLevel LogLevel, msg string, attrs ...slog.Attr) {
+	if l.LogLevel >= logLevel {
+		l.output(logLevel, msg, attrs)
+	}
+}
+
+func (l *Logger) output(logLevel LogLevel, msg string, attrs []slog.Attr) {
+	msg = strings.TrimSuffix(msg, "\n")
+	if logFormat == LogFormatJSON {
+		l.json.LogAttrs(context.Background(), logLevel.slogLevel(), msg, attrs...)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, attr := range attrs {
+		var value string
+		if attr.Value.Kind() == slog.KindFloat64 {
+			value = strconv.FormatFloat(attr.Value.Float64(), 'f', -1, 64)
+		} else {
+			value = attr.Value.String()
+		}
+		if value == "" || strings.ContainsAny(value, " \"=\n") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", attr.Key, value)
+	}
+	l.text.Print(b.String())
+}
+
+// logWriter writes the lines of a standard logger to a Logger.
+type logWriter struct {
+	logger *Logger
+	level  LogLevel
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.logger.Logf(w.level, "%s", p)
+	return len(p), nil
+}
+
+// StandardLogger returns a standard logger writing to the logger at the level, for the packages logging with
+// one, e.g. net/http.
+func (l *Logger) StandardLogger(level LogLevel) *log.Logger {
+	return log.New(&logWriter{logger: l, level: level}, "", 0)
+}
+
 func CreateLogger(prefix string, logLevel LogLevel) *Logger {
 	return &Logger{
-		Printf:   log.New(os.Stderr, fmt.Sprintf("[%s] ", prefix), log.LstdFlags).Printf,
+		Prefix:   prefix,
 		LogLevel: logLevel,
+		text:     log.New(os.Stderr, fmt.Sprintf("[%s] ", prefix), log.LstdFlags),
+		json:     slog.New(jsonHandler).With("logger", prefix),
 	}
 }
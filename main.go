@@ -5,7 +5,6 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 
 	"tailscale.com/tsnet"
@@ -14,12 +13,20 @@ import (
 type Logf func(format string, args ...any)
 
 func main() {
+	// Subcommands talk to a running instance instead of starting one.
+	if len(os.Args) > 1 {
+		if command := findCtlCommand(os.Args[1]); command != nil {
+			os.Exit(RunCtl(command, os.Args[2:]))
+		}
+	}
+
 	logger := CreateLogger("main", Info)
 
-	config, err := GetConfig()
+	config, args, err := GetConfig()
 	if err != nil {
 		logger.Fatalf("invalid config: %v", err)
 	}
+	SetLogFormat(config.LogFormat)
 
 	if err := config.ProcessServices(); err != nil {
 		logger.Fatalf("invalid service config: %v", err)
@@ -41,42 +48,31 @@ func main() {
 	tsnet.Logf = tsLogger.Verbosef
 	tsnet.UserLogf = tsLogger.Infof
 
-	shutdownCh := make(chan struct{})
-	shutdownWg := &sync.WaitGroup{}
 	serviceContext := &ServiceContext{
-		TsNet:      tsnet,
-		ShutdownCh: shutdownCh,
-		ShutdownWg: shutdownWg,
+		TsNet:   tsnet,
+		Config:  config,
+		Logger:  logger,
+		Metrics: NewMetrics(),
 	}
+	defer serviceContext.CloseTailscale()
 
-	usingTailscale := false
 	if config.Tailscale.Listen.Socks5 != "" || config.Tailscale.Listen.HTTP != "" {
-		usingTailscale = true
+		if err := serviceContext.StartTailscale(); err != nil {
+			logger.Fatalf("%v", err)
+		}
 	}
 
-	var services []*Service
-	for name, serviceConfig := range config.Services {
-		service, err := CreateService(serviceContext, name, serviceConfig)
+	if config.Metrics.Listen != "" {
+		stop, err := StartMetricsServer(serviceContext, logger, config.Metrics.Listen)
 		if err != nil {
-			logger.Fatalf("failed to create service %q: %v", name, err)
-		}
-		if service.ListenType == AddressTailscaleTCP || service.ConnectType == AddressTailscaleTCP {
-			usingTailscale = true
+			logger.Fatalf("%v", err)
 		}
-		services = append(services, service)
+		defer stop()
 	}
 
-	if usingTailscale {
-		if err := config.ValidateTailscaleConfig(); err != nil {
-			logger.Fatalf("Tailscale used but got invalid Tailscale config: %v", err)
-		}
-		if config.Tailscale.AuthKey == "" {
-			logger.Infof("Tailscale authkey not provided, will try interactive login")
-		}
-		if err := tsnet.Start(); err != nil {
-			logger.Fatalf("failed to start Tailscale: %v", err)
-		}
-		defer tsnet.Close()
+	manager := NewServiceManager(serviceContext, logger)
+	if err := manager.Apply(config); err != nil {
+		logger.Fatalf("%v", err)
 	}
 
 	somethingRunning := false
@@ -97,20 +93,51 @@ func main() {
 		}
 	}
 
-	// Start services.
-	for _, service := range services {
+	if len(config.Services) > 0 {
+		somethingRunning = true
+	}
+
+	// Services could be added at runtime with the admin API.
+	if config.Admin.Listen != "" {
+		reload := func() error {
+			return ReloadConfig(args, manager, logger)
+		}
+		stop, err := StartAdminServer(serviceContext, manager, reload, logger, config.Admin.Listen)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		defer stop()
 		somethingRunning = true
-		go service.Start()
 	}
 
 	if !somethingRunning {
 		logger.Fatalf("no listener defined. run %s -h for help", os.Args[0])
 	}
 
-	// Wait for signal to shutdown.
+	reloadCh := make(chan struct{}, 1)
+	if args.conf != "" {
+		if err := WatchConfigFile(args.conf, reloadCh); err != nil {
+			logger.Errorf("failed to watch config file, only reloading on SIGHUP: %v", err)
+		}
+	}
+
+	// Reload on SIGHUP or config file change, and wait for signal to shutdown.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	<-c
-	close(shutdownCh)
-	shutdownWg.Wait()
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-c:
+			if sig == syscall.SIGHUP {
+				ReloadConfig(args, manager, logger)
+				continue
+			}
+			// Stop accepting, and wait for the connections to finish. A second signal closes them at once.
+			signal.Ignore(syscall.SIGHUP)
+			manager.StopAll()
+			serviceContext.Drain(manager.Config().DrainTimeout, c)
+			return
+		case <-reloadCh:
+			ReloadConfig(args, manager, logger)
+		}
+	}
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a restarted service may take to start listening before it's considered failed, since the manager is
+// locked meanwhile, e.g. while waiting for Tailscale.
+const restartListenTimeout = 10 * time.Second
+
+// ServiceManager runs the services and applies config changes to them at runtime.
+type ServiceManager struct {
+	context *ServiceContext
+	logger  *Logger
+
+	mu sync.Mutex
+	// The config last applied, whose defaults are used by services added at runtime.
+	config   *Config
+	services map[string]*Service
+}
+
+func NewServiceManager(serviceContext *ServiceContext, logger *Logger) *ServiceManager {
+	return &ServiceManager{
+		context:  serviceContext,
+		logger:   logger,
+		services: make(map[string]*Service),
+	}
+}
+
+// Apply makes the running services match the services of config: new services are started, removed ones
+// are stopped and changed ones are restarted, while unchanged ones are left alone. Nothing is changed if any
+// of the new or changed services is invalid. A changed service failing to listen is restarted with its old config
+// instead, and reported in the error.
+func (m *ServiceManager) Apply(config *Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	configs := config.Services
+	created := make(map[string]*Service)
+	for name, config := range configs {
+		if running, ok := m.services[name]; ok && reflect.DeepEqual(running.Config, config) {
+			continue
+		}
+		service, err := CreateService(m.context, name, config)
+		if err != nil {
+			return fmt.Errorf("failed to create service %q: %v", name, err)
+		}
+		created[name] = service
+	}
+
+	for _, service := range created {
+		if service.UsesTailscale() {
+			if err := m.context.StartTailscale(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	for name, service := range m.services {
+		if _, ok := configs[name]; !ok {
+			m.logger.Infof("stopping removed service %q", name)
+			service.Stop()
+			service.metrics.delete()
+			delete(m.services, name)
+		}
+	}
+	var errs []error
+	for name, service := range created {
+		// The old listener must be closed before the new one is opened on the same address.
+		running, restarting := m.services[name]
+		var metrics *serviceMetrics
+		if restarting {
+			m.logger.Infof("restarting changed service %q", name)
+			running.Stop()
+			metrics = running.metrics
+		}
+		m.start(service, metrics)
+		if !restarting {
+			continue
+		}
+		if err := service.WaitListening(restartListenTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restart changed service %q: %v", name, err))
+			service.Stop()
+			m.rollback(name, running)
+		}
+	}
+	m.config = config
+	return errors.Join(errs...)
+}
+
+// rollback starts a service stopped for a restart again with its old config, removing it if it fails to.
+func (m *ServiceManager) rollback(name string, stopped *Service) {
+	m.logger.Infof("restarting service %q with its old config", name)
+	service, err := CreateService(m.context, name, stopped.Config)
+	if err == nil {
+		m.start(service, stopped.metrics)
+		err = service.WaitListening(restartListenTimeout)
+	}
+	if err != nil {
+		m.logger.Errorf("failed to restart service %q with its old config, removing it: %v", name, err)
+		if service != nil {
+			service.Stop()
+		}
+		stopped.metrics.delete()
+		delete(m.services, name)
+	}
+}
+
+// Add starts a new service at runtime. It's removed on the next reload unless it's also in the config file.
+func (m *ServiceManager) Add(name string, config *ServiceConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.services[name]; ok {
+		return fmt.Errorf("service %q already exists", name)
+	}
+	if !nameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid service name: %s", name)
+	}
+	if err := m.config.ProcessService(name, config); err != nil {
+		return err
+	}
+	service, err := CreateService(m.context, name, config)
+	if err != nil {
+		return fmt.Errorf("failed to create service %q: %v", name, err)
+	}
+	if service.UsesTailscale() {
+		if err := m.context.StartTailscale(); err != nil {
+			return err
+		}
+	}
+
+	m.logger.Infof("starting added service %q", name)
+	m.start(service, nil)
+	return nil
+}
+
+// start registers and starts a created service, with the metric series of the service it replaces if not nil, or
+// new ones.
+func (m *ServiceManager) start(service *Service, metrics *serviceMetrics) {
+	if metrics == nil {
+		metrics = newServiceMetrics(m.context.Metrics, service.Name)
+	}
+	service.metrics = metrics
+	m.services[service.Name] = service
+	go service.Start()
+}
+
+// Remove stops a service at runtime. It's started again on the next reload if it's in the config file.
+func (m *ServiceManager) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	service, ok := m.services[name]
+	if !ok {
+		return fmt.Errorf("service %q not found", name)
+	}
+	m.logger.Infof("stopping removed service %q", name)
+	service.Stop()
+	service.metrics.delete()
+	delete(m.services, name)
+	return nil
+}
+
+// Config returns the config last applied.
+func (m *ServiceManager) Config() *Config {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config
+}
+
+// Service returns the running service with the name, nil if not found.
+func (m *ServiceManager) Service(name string) *Service {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.services[name]
+}
+
+// Services returns the running services, sorted by name.
+func (m *ServiceManager) Services() []*Service {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	services := make([]*Service, 0, len(m.services))
+	for _, service := range m.services {
+		services = append(services, service)
+	}
+	slices.SortFunc(services, func(a, b *Service) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return services
+}
+
+// StopAll stops all services.
+func (m *ServiceManager) StopAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, service := range m.services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			service.Stop()
+		}()
+	}
+	wg.Wait()
+	clear(m.services)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	connectionDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+	dialDurationBuckets       = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+type metricType string
+
+const (
+	metricCounter   metricType = "counter"
+	metricGauge     metricType = "gauge"
+	metricHistogram metricType = "histogram"
+)
+
+// MetricVec is a metric family, with a series for each combination of label values.
+type MetricVec struct {
+	Name       string
+	Help       string
+	Type       metricType
+	LabelNames []string
+	// Upper bounds of the buckets of histograms, in ascending order.
+	Buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*Metric
+}
+
+// With returns the series with the label values, in the order of the label names.
+func (v *MetricVec) With(labelValues ...string) *Metric {
+	key := strings.Join(labelValues, "\x00")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if metric, ok := v.series[key]; ok {
+		return metric
+	}
+	metric := &Metric{labelValues: labelValues}
+	if v.Type == metricHistogram {
+		metric.bucketCounts = make([]uint64, len(v.Buckets))
+	}
+	v.series[key] = metric
+	return metric
+}
+
+// deleteLabel deletes the series with the value of the label.
+func (v *MetricVec) deleteLabel(name, value string) {
+	i := slices.Index(v.LabelNames, name)
+	if i < 0 {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, metric := range v.series {
+		if metric.labelValues[i] == value {
+			delete(v.series, key)
+		}
+	}
+}
+
+// Metric is a single series of a counter, gauge or histogram.
+type Metric struct {
+	labelValues []string
+
+	// Of counters and gauges.
+	value atomic.Int64
+
+	// Of histograms.
+	mu           sync.Mutex
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+func (m *Metric) Add(n int64) {
+	m.value.Add(n)
+}
+
+func (m *Metric) Inc() {
+	m.value.Add(1)
+}
+
+func (m *Metric) Dec() {
+	m.value.Add(-1)
+}
+
+func (m *Metric) Set(n int64) {
+	m.value.Store(n)
+}
+
+func (m *Metric) Value() int64 {
+	return m.value.Load()
+}
+
+// Observe adds a sample to a histogram with the bucket upper bounds.
+func (m *Metric) Observe(buckets []float64, sample float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range buckets {
+		if sample <= bound {
+			m.bucketCounts[i]++
+		}
+	}
+	m.count++
+	m.sum += sample
+}
+
+// Metrics is the registry of all metrics, exported in the Prometheus text format.
+type Metrics struct {
+	ConnectionsAccepted *MetricVec
+	ConnectionsActive   *MetricVec
+	ConnectionDuration  *MetricVec
+	ConnectionsClosed   *MetricVec
+	Bytes               *MetricVec
+	DialFailures        *MetricVec
+	DialDuration        *MetricVec
+
+	Draining               *MetricVec
+	DrainClosedConnections *MetricVec
+
+	TailscaleRunning     *MetricVec
+	TailscalePeers       *MetricVec
+	TailscalePeersOnline *MetricVec
+
+	vecs []*MetricVec
+	// Called before each scrape to update the metrics not tracked as they change.
+	collectorsMu sync.Mutex
+	collectors   []func()
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.ConnectionsAccepted = m.newVec("tsukasa_connections_accepted_total", "Connections (or UDP sessions) accepted by services.", metricCounter, nil, "service")
+	m.ConnectionsActive = m.newVec("tsukasa_connections_active", "Connections (or UDP sessions) currently handled by services.", metricGauge, nil, "service")
+	m.ConnectionDuration = m.newVec("tsukasa_connection_duration_seconds", "Duration of connections (or UDP sessions) from accepting to closing.", metricHistogram, connectionDurationBuckets, "service")
+	m.ConnectionsClosed = m.newVec("tsukasa_connections_closed_total", "Connections (or UDP sessions) closed by services, by the reason in the access log.", metricCounter, nil, "service", "reason")
+	m.Bytes = m.newVec("tsukasa_bytes_total", "Bytes forwarded from clients to targets (in) and from targets to clients (out).", metricCounter, nil, "service", "direction")
+	m.DialFailures = m.newVec("tsukasa_dial_failures_total", "Failures to connect to targets.", metricCounter, nil, "service", "target", "reason")
+	m.DialDuration = m.newVec("tsukasa_dial_duration_seconds", "Time taken to connect to targets, successfully or not.", metricHistogram, dialDurationBuckets, "service", "target")
+	m.Draining = m.newVec("tsukasa_draining", "Whether the connections are being drained on shutdown.", metricGauge, nil)
+	m.DrainClosedConnections = m.newVec("tsukasa_drain_closed_connections_total", "Connections closed since they didn't finish before the drain timeout.", metricCounter, nil)
+	m.TailscaleRunning = m.newVec("tsukasa_tailscale_running", "Whether the Tailscale backend is running.", metricGauge, nil)
+	m.TailscalePeers = m.newVec("tsukasa_tailscale_peers", "Peers in the tailnet visible to the Tailscale node.", metricGauge, nil)
+	m.TailscalePeersOnline = m.newVec("tsukasa_tailscale_peers_online", "Online peers in the tailnet visible to the Tailscale node.", metricGauge, nil)
+	return m
+}
+
+func (m *Metrics) newVec(name, help string, typ metricType, buckets []float64, labelNames ...string) *MetricVec {
+	vec := &MetricVec{
+		Name:       name,
+		Help:       help,
+		Type:       typ,
+		LabelNames: labelNames,
+		Buckets:    buckets,
+		series:     make(map[string]*Metric),
+	}
+	m.vecs = append(m.vecs, vec)
+	return vec
+}
+
+// OnCollect registers a function to be called before each scrape.
+func (m *Metrics) OnCollect(collector func()) {
+	m.collectorsMu.Lock()
+	defer m.collectorsMu.Unlock()
+	m.collectors = append(m.collectors, collector)
+}
+
+// Write writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) error {
+	m.collectorsMu.Lock()
+	for _, collector := range m.collectors {
+		collector()
+	}
+	m.collectorsMu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, vec := range m.vecs {
+		vec.mu.Lock()
+		series := make([]*Metric, 0, len(vec.series))
+		for _, metric := range vec.series {
+			series = append(series, metric)
+		}
+		vec.mu.Unlock()
+		if len(series) == 0 {
+			continue
+		}
+		slices.SortFunc(series, func(a, b *Metric) int {
+			return slices.Compare(a.labelValues, b.labelValues)
+		})
+
+		fmt.Fprintf(bw, "# HELP %s %s\n", vec.Name, vec.Help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", vec.Name, vec.Type)
+		for _, metric := range series {
+			labels := formatLabels(vec.LabelNames, metric.labelValues)
+			if vec.Type != metricHistogram {
+				fmt.Fprintf(bw, "%s%s %d\n", vec.Name, labels, metric.Value())
+				continue
+			}
+
+			metric.mu.Lock()
+			for i, bound := range vec.Buckets {
+				le := formatLabels(append(slices.Clone(vec.LabelNames), "le"), append(slices.Clone(metric.labelValues), strconv.FormatFloat(bound, 'g', -1, 64)))
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", vec.Name, le, metric.bucketCounts[i])
+			}
+			le := formatLabels(append(slices.Clone(vec.LabelNames), "le"), append(slices.Clone(metric.labelValues), "+Inf"))
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", vec.Name, le, metric.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", vec.Name, labels, strconv.FormatFloat(metric.sum, 'g', -1, 64))
+			fmt.Fprintf(bw, "%s_count%s %d\n", vec.Name, labels, metric.count)
+			metric.mu.Unlock()
+		}
+	}
+	return bw.Flush()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		labelValueReplacer.WriteString(&b, values[i])
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
+
+// serviceMetrics are the series of a service, shared by its instances restarted on config changes.
+type serviceMetrics struct {
+	metrics             *Metrics
+	service             string
+	connectionsAccepted *Metric
+	connectionsActive   *Metric
+	connectionDuration  *Metric
+	bytesIn             *Metric
+	bytesOut            *Metric
+
+	// Held while adding series, which are no longer added once deleted.
+	mu      sync.Mutex
+	deleted bool
+}
+
+func newServiceMetrics(m *Metrics, service string) *serviceMetrics {
+	return &serviceMetrics{
+		metrics:             m,
+		service:             service,
+		connectionsAccepted: m.ConnectionsAccepted.With(service),
+		connectionsActive:   m.ConnectionsActive.With(service),
+		connectionDuration:  m.ConnectionDuration.With(service),
+		bytesIn:             m.Bytes.With(service, "in"),
+		bytesOut:            m.Bytes.With(service, "out"),
+	}
+}
+
+// with returns the series of the service in vec with the label values, or one not exported once deleted, e.g.
+// for the connections finishing after the service is removed.
+func (m *serviceMetrics) with(vec *MetricVec, labelValues ...string) *Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deleted {
+		return &Metric{labelValues: labelValues, bucketCounts: make([]uint64, len(vec.Buckets))}
+	}
+	return vec.With(labelValues...)
+}
+
+// delete deletes the series of a removed service from all metrics.
+func (m *serviceMetrics) delete() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = true
+	for _, vec := range m.metrics.vecs {
+		vec.deleteLabel("service", m.service)
+	}
+}
+
+// connectionStarted records an accepted connection (or UDP session), and returns the function to call
+// with the reason once it's closed.
+func (m *serviceMetrics) connectionStarted() (closed func(reason string)) {
+	start := time.Now()
+	m.connectionsAccepted.Inc()
+	m.connectionsActive.Inc()
+	return func(reason string) {
+		m.connectionsActive.Dec()
+		m.connectionDuration.Observe(connectionDurationBuckets, time.Since(start).Seconds())
+		m.with(m.metrics.ConnectionsClosed, m.service, reason).Inc()
+	}
+}
+
+// reportDialMetrics records the duration and the failure reason (if any) of connecting to a target.
+func (s *Service) reportDialMetrics(target *Target, duration time.Duration, err error) {
+	metrics := s.ServiceContext.Metrics
+	s.metrics.with(metrics.DialDuration, s.Name, target.URL).Observe(dialDurationBuckets, duration.Seconds())
+	if err != nil {
+		s.metrics.with(metrics.DialFailures, s.Name, target.URL, dialFailureReason(err)).Inc()
+	}
+}
+
+// dialFailureReason classifies a dial error for the reason label of metrics.
+func dialFailureReason(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var tlsErr *tlsHandshakeError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, os.ErrNotExist):
+		return "not_found"
+	case errors.As(err, &tlsErr):
+		return "tls"
+	default:
+		return "other"
+	}
+}
+
+// collectTailscaleMetrics updates the metrics of the Tailscale node on scrapes.
+func (c *ServiceContext) collectTailscaleMetrics() {
+	running, peers, online := int64(0), int64(0), int64(0)
+	defer func() {
+		c.Metrics.TailscaleRunning.With().Set(running)
+		c.Metrics.TailscalePeers.With().Set(peers)
+		c.Metrics.TailscalePeersOnline.With().Set(online)
+	}()
+
+	if !c.TailscaleStarted() {
+		return
+	}
+	localClient, err := c.TsNet.LocalClient()
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	status, err := localClient.Status(ctx)
+	if err != nil {
+		c.Logger.Errorf("failed to get Tailscale status for metrics: %v", err)
+		return
+	}
+	if status.BackendState == "Running" {
+		running = 1
+	}
+	for _, peer := range status.Peer {
+		peers++
+		if peer.Online {
+			online++
+		}
+	}
+}
+
+// StartMetricsServer serves the metrics at /metrics on a TCP, UNIX socket or Tailscale listen URL until
+// stopped.
+func StartMetricsServer(serviceContext *ServiceContext, logger *Logger, listenUrl string) (stop func(), err error) {
+	addressType, address, port, err := parseUrl(urlTypeListen, listenUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics listen URL: %v", err)
+	}
+	if addressType.IsDatagram() {
+		return nil, fmt.Errorf("invalid metrics listen URL: %s is not a stream address", listenUrl)
+	}
+	if addressType.IsTLS() {
+		return nil, fmt.Errorf("invalid metrics listen URL: TLS is not supported")
+	}
+	if addressType.IsTailscale() {
+		if err := serviceContext.StartTailscale(); err != nil {
+			return nil, err
+		}
+	}
+	listener, cleanup, err := serviceContext.Listen(addressType, address, port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start metrics server on %s: %v", listenUrl, err)
+	}
+
+	serviceContext.Metrics.OnCollect(serviceContext.collectTailscaleMetrics)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", serviceContext.Metrics)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			cleanup()
+			logger.Fatalf("failed to serve metrics on %s: %v", listenUrl, err)
+		}
+	}()
+	logger.Infof("serving metrics on %s", listenUrl)
+	return func() {
+		server.Close()
+		cleanup()
+	}, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	defaultSniffTimeout = 2 * time.Second
+	// The most bytes read from a connection to detect its protocol.
+	maxSniffSize = 1024
+)
+
+// The prefixes of the first bytes of connections, by the protocols detected by mux services.
+var muxProtocolPrefixes = map[string][]string{
+	"ssh": {"SSH-"},
+	// The record header of a handshake, which a ClientHello starts with.
+	"tls":   {"\x16\x03"},
+	"http":  {"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH ", "PRI * HTTP/2.0"},
+	"proxy": {"PROXY ", string(proxyV2Signature)},
+}
+
+type sniffResult int
+
+const (
+	sniffNoMatch sniffResult = iota
+	sniffMatch
+	// More bytes are needed to tell.
+	sniffMore
+)
+
+// Sniff tells whether a connection of a mux service starting with the bytes is routed by the route, final if no
+// more bytes are coming. A pattern is matched against the bytes received first as is, which are usually the
+// first message of the client, and may still match once more bytes are received.
+func (r *Route) Sniff(data []byte, final bool) sniffResult {
+	switch {
+	case r.Protocol != "":
+		result := sniffNoMatch
+		for _, prefix := range muxProtocolPrefixes[r.Protocol] {
+			if bytes.HasPrefix(data, []byte(prefix)) {
+				return sniffMatch
+			}
+			if bytes.HasPrefix([]byte(prefix), data) {
+				result = sniffMore
+			}
+		}
+		return result
+	case r.Pattern != nil:
+		if r.Pattern.Match(data) {
+			return sniffMatch
+		}
+		if !final {
+			return sniffMore
+		}
+		return sniffNoMatch
+	default:
+		return sniffMatch
+	}
+}
+
+// matchSniffedRoute returns the first route matching the first bytes of a connection, or whether more bytes are
+// needed to tell. Routes needing more bytes don't match once no more bytes are coming.
+func (s *Service) matchSniffedRoute(data []byte, final bool) (route *Route, decided bool) {
+	for _, route := range s.Routes {
+		switch route.Sniff(data, final) {
+		case sniffMatch:
+			return route, true
+		case sniffMore:
+			if !final {
+				return nil, false
+			}
+		}
+	}
+	return nil, true
+}
+
+// sniffRoute reads the first bytes of a connection until its route is told, returning the route (nil if none)
+// and the connection replaying the bytes read. Once the sniff timeout is reached without enough bytes (e.g. for
+// protocols where the server speaks first), the route is matched with the bytes read so far.
+func (s *Service) sniffRoute(conn net.Conn) (*Route, net.Conn, error) {
+	data := make([]byte, 0, maxSniffSize)
+	conn.SetReadDeadline(time.Now().Add(s.SniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	final := false
+	for {
+		if route, decided := s.matchSniffedRoute(data, final); decided {
+			return route, &peekedConn{Conn: conn, peeked: data}, nil
+		}
+		n, err := conn.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err != nil {
+			if len(data) == 0 && !errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, nil, err
+			}
+			final = true
+		} else if len(data) == cap(data) {
+			final = true
+		}
+	}
+}
@@ -1,34 +1,238 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"net"
+	"os"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-func PipeAndClose(conn net.Conn, targetConn net.Conn, logger *Logger) {
-	var closed uint32 = 0
-	close := func() {
-		if atomic.CompareAndSwapUint32(&closed, 0, 1) {
+// countingWriter reports the bytes written through it to count.
+type countingWriter struct {
+	w     io.Writer
+	count func(n int64)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.count(int64(n))
+	return n, err
+}
+
+// The size of the buffers copying connections which can't be spliced, e.g. Tailscale ones.
+const copyBufferSize = 64 << 10
+
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// kernelSocket returns the TCP or UNIX socket of a connection, unwrapping the wrappers which don't change the
+// bytes (unlike TLS), or nil if it's not one.
+func kernelSocket(conn net.Conn) syscall.Conn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *net.UnixConn:
+			return c
+		case *peekedConn:
+			conn = c.Conn
+		case *ProxiedConn:
+			conn = c.Conn
+		case *funnelConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// readAhead returns the bytes the wrappers of a connection have read from the socket but not returned yet,
+// outermost first. It must be called by the reader of the connection.
+func readAhead(conn net.Conn) (buffers [][]byte) {
+	for {
+		switch c := conn.(type) {
+		case *peekedConn:
+			buffers = append(buffers, c.peeked)
+			conn = c.Conn
+		case *ProxiedConn:
+			buffered, _ := c.reader.Peek(c.reader.Buffered())
+			buffers = append(buffers, buffered)
+			conn = c.Conn
+		case *funnelConn:
+			conn = c.Conn
+		default:
+			return buffers
+		}
+	}
+}
+
+// copyConn forwards from src to dst until EOF, reporting the bytes forwarded to count. Between kernel sockets,
+// it's done with splice(2) if available, otherwise with pooled buffers.
+func copyConn(dst, src net.Conn, count func(n int64)) error {
+	srcSocket, dstSocket := kernelSocket(src), kernelSocket(dst)
+	if srcSocket != nil && dstSocket != nil {
+		for _, buffered := range readAhead(src) {
+			if len(buffered) == 0 {
+				continue
+			}
+			n, err := dst.Write(buffered)
+			count(int64(n))
+			if err != nil {
+				return err
+			}
+		}
+		if handled, err := spliceConn(dstSocket, srcSocket, count); handled {
+			return err
+		}
+		// Read the socket directly, since the read ahead bytes are forwarded.
+		src = srcSocket.(net.Conn)
+	}
+
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	// Hide the WriterTo of src (e.g. TCP), which copies with its own buffer.
+	_, err := io.CopyBuffer(&countingWriter{dst, count}, struct{ io.Reader }{src}, *buf)
+	return err
+}
+
+// The time to wait for the other direction to forward anything after one side of a connection half-closes,
+// before closing both.
+const halfCloseTimeout = 30 * time.Second
+
+// closeWrite shuts down the writing side of a connection (e.g. TCP, UNIX socket, Tailscale TCP or TLS),
+// unwrapping the connections wrapped by NetConn. It reports whether the connection supports half-close.
+func closeWrite(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite() == nil
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return false
+		}
+	}
+}
+
+// PipeAndClose forwards data between conn and targetConn until both sides are closed, reporting the bytes
+// from conn to targetConn to countIn and the other way to countOut. Once a side closes, the other one is
+// half-closed so it sees EOF and can still reply, and both are closed once it closes too, once it has
+// forwarded nothing for halfCloseTimeout, or if half-close isn't supported. It returns the reason of the
+// forwarding finishing, which is the side closing first, or an error.
+func PipeAndClose(conn net.Conn, targetConn net.Conn, logger *Logger, countIn, countOut func(n int64)) string {
+	var reason atomic.Value
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
 			conn.Close()
 			targetConn.Close()
+		})
+	}
+
+	// When each direction last forwarded bytes, for the other one lingering after half-close.
+	var lastActiveIn, lastActiveOut atomic.Int64
+	// Closed once both directions are done, to stop lingering.
+	done := make(chan struct{})
+	linger := func(lastActive *atomic.Int64) {
+		lastActive.Store(time.Now().UnixNano())
+		go func() {
+			timer := time.NewTimer(halfCloseTimeout)
+			defer timer.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-timer.C:
+					idle := time.Since(time.Unix(0, lastActive.Load()))
+					if idle >= halfCloseTimeout {
+						closeBoth()
+						return
+					}
+					timer.Reset(halfCloseTimeout - idle)
+				}
+			}
+		}()
+	}
+
+	pipe := func(dst, src net.Conn, count func(n int64), lastActive, otherLastActive *atomic.Int64, closedReason, direction string) {
+		err := copyConn(dst, src, func(n int64) {
+			lastActive.Store(time.Now().UnixNano())
+			count(n)
+		})
+		if err == nil {
+			if reason.CompareAndSwap(nil, closedReason) && closeWrite(dst) {
+				linger(otherLastActive)
+				return
+			}
+			closeBoth()
+			return
+		}
+		if reason.Load() == nil && !errors.Is(err, net.ErrClosed) {
+			logger.Errorf("error copying data %s target: %v", direction, err)
 		}
+		reason.CompareAndSwap(nil, closeReasonError)
+		closeBoth()
 	}
 
 	// Forward data between conn and targetConn.
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		defer close()
+		defer wg.Done()
+		pipe(targetConn, conn, countIn, &lastActiveIn, &lastActiveOut, closeReasonClientClosed, "to")
+	}()
+	pipe(conn, targetConn, countOut, &lastActiveOut, &lastActiveIn, closeReasonTargetClosed, "from")
+	wg.Wait()
+
+	close(done)
+	closeBoth()
+	return reason.Load().(string)
+}
 
-		_, err := io.Copy(targetConn, conn)
-		if err != nil && atomic.LoadUint32(&closed) == 0 {
-			logger.Errorf("error copying data to target: %v\n", err)
+// PipeDatagrams forwards the datagrams replied by the target of a session back to the client through
+// packetConn, until the session has seen no traffic in either direction for idleTimeout, reporting the bytes
+// to countOut. The datagrams from the client are written to session.TargetConn by the receiving loop of
+// the service. It returns the reason of the session ending.
+func PipeDatagrams(packetConn net.PacketConn, session *DatagramSession, idleTimeout time.Duration, logger *Logger, countOut func(n int64)) string {
+	defer session.TargetConn.Close()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		deadline := session.LastActive().Add(idleTimeout)
+		if !time.Now().Before(deadline) {
+			return closeReasonIdle
 		}
-		conn.Close()
-	}()
+		session.TargetConn.SetReadDeadline(deadline)
 
-	defer close()
+		n, err := session.TargetConn.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// Re-check the deadline since the client may have sent something meanwhile.
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return closeReasonServiceStopped
+			}
+			logger.Errorf("error receiving datagram from target: %v", err)
+			return closeReasonError
+		}
 
-	if _, err := io.Copy(conn, targetConn); err != nil && atomic.LoadUint32(&closed) == 0 {
-		logger.Errorf("error copying data from target: %v\n", err)
+		session.Touch()
+		if _, err := packetConn.WriteTo(buf[:n], session.ClientAddr); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return closeReasonServiceStopped
+			}
+			logger.Errorf("error sending datagram to client: %v", err)
+			return closeReasonError
+		}
+		countOut(int64(n))
 	}
 }
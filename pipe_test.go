@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// socketPair returns both ends of a connection over loopback TCP or a UNIX socket.
+func socketPair(tb testing.TB, network string) (net.Conn, net.Conn) {
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(tb.TempDir(), "pair.sock")
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial(network, listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		tb.Fatal("failed to accept")
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// userspaceConn hides the kernel socket of a connection, which is then copied through user space like the
+// Tailscale connections.
+type userspaceConn struct {
+	net.Conn
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+// benchmarkPipe measures forwarding from a client to a target through PipeAndClose, the connections accepted
+// from the client and made to the target being wrapped by wrap.
+func benchmarkPipe(b *testing.B, clientNetwork, targetNetwork string, wrap func(net.Conn) net.Conn) {
+	client, conn := socketPair(b, clientNetwork)
+	targetConn, target := socketPair(b, targetNetwork)
+	piped := make(chan struct{})
+	go func() {
+		defer close(piped)
+		PipeAndClose(wrap(conn), wrap(targetConn), CreateLogger("test", Error), func(n int64) {}, func(n int64) {})
+	}()
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, target)
+		received <- n
+	}()
+
+	buf := randomBytes(copyBufferSize)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	closeWrite(client)
+	if n := <-received; n != int64(b.N*len(buf)) {
+		b.Fatalf("received %d bytes, want %d", n, b.N*len(buf))
+	}
+	b.StopTimer()
+	target.Close()
+	<-piped
+}
+
+func unwrapped(conn net.Conn) net.Conn {
+	return conn
+}
+
+func userspace(conn net.Conn) net.Conn {
+	return &userspaceConn{conn}
+}
+
+func BenchmarkPipeTCP(b *testing.B) {
+	benchmarkPipe(b, "tcp", "tcp", unwrapped)
+}
+
+func BenchmarkPipeUNIX(b *testing.B) {
+	benchmarkPipe(b, "unix", "unix", unwrapped)
+}
+
+func BenchmarkPipeTCPToUNIX(b *testing.B) {
+	benchmarkPipe(b, "tcp", "unix", unwrapped)
+}
+
+func BenchmarkPipeUNIXToTCP(b *testing.B) {
+	benchmarkPipe(b, "unix", "tcp", unwrapped)
+}
+
+func BenchmarkPipeUserspace(b *testing.B) {
+	benchmarkPipe(b, "tcp", "tcp", userspace)
+}
+
+// The bytes read ahead by PROXY protocol and sniffing are forwarded before the spliced ones, in order.
+func TestCopyConnReadAhead(t *testing.T) {
+	client, conn := socketPair(t, "tcp")
+	targetConn, target := socketPair(t, "unix")
+	data := randomBytes(4 << 20)
+
+	// Written at once, so that the reader of the PROXY protocol header buffers some data.
+	header := []byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n")
+	if _, err := client.Write(append(header, data[:100]...)); err != nil {
+		t.Fatal(err)
+	}
+	proxiedConn, err := AcceptProxyHeader(conn, defaultProxyProtocolTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peeked := make([]byte, 10)
+	if _, err := io.ReadFull(proxiedConn, peeked); err != nil {
+		t.Fatal(err)
+	}
+	src := &peekedConn{Conn: proxiedConn, peeked: peeked}
+	go func() {
+		client.Write(data[100:])
+		closeWrite(client)
+	}()
+
+	var counted atomic.Int64
+	copied := make(chan error, 1)
+	go func() {
+		copied <- copyConn(targetConn, src, func(n int64) { counted.Add(n) })
+		closeWrite(targetConn)
+	}()
+	received, err := io.ReadAll(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-copied; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes different from the %d sent", len(received), len(data))
+	}
+	if n := counted.Load(); n != int64(len(data)) {
+		t.Fatalf("counted %d bytes, want %d", n, len(data))
+	}
+}
+
+// A splice failing to write to a reset target is reported, and the next connection is still forwarded byte for
+// byte.
+func TestSpliceConnPartialWrite(t *testing.T) {
+	client, conn := socketPair(t, "tcp")
+	targetConn, target := socketPair(t, "tcp")
+	go client.Write(randomBytes(16 << 20))
+	go func(target *net.TCPConn) {
+		target.Read(make([]byte, 1))
+		target.SetLinger(0)
+		target.Close()
+	}(target.(*net.TCPConn))
+	handled, err := spliceConn(targetConn.(*net.TCPConn), conn.(*net.TCPConn), func(n int64) {})
+	if !handled {
+		t.Skip("splice is not available")
+	}
+	if err == nil {
+		t.Fatal("splicing to a reset connection succeeded")
+	}
+	client.Close()
+
+	client, conn = socketPair(t, "tcp")
+	targetConn, target = socketPair(t, "tcp")
+	data := randomBytes(1 << 20)
+	go func() {
+		client.Write(data)
+		closeWrite(client)
+	}()
+	spliced := make(chan error, 1)
+	go func() {
+		_, err := spliceConn(targetConn.(*net.TCPConn), conn.(*net.TCPConn), func(n int64) {})
+		spliced <- err
+		closeWrite(targetConn)
+	}()
+	received, err := io.ReadAll(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-spliced; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes different from the %d sent", len(received), len(data))
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ProxyProtocolVersion int
+
+const (
+	ProxyProtocolNone ProxyProtocolVersion = 0
+	ProxyProtocolV1   ProxyProtocolVersion = 1
+	ProxyProtocolV2   ProxyProtocolVersion = 2
+)
+
+func (v ProxyProtocolVersion) String() string {
+	switch v {
+	case ProxyProtocolNone:
+		return "none"
+	case ProxyProtocolV1:
+		return "v1"
+	case ProxyProtocolV2:
+		return "v2"
+	default:
+		return fmt.Sprintf("ProxyProtocolVersion(%d)", int(v))
+	}
+}
+
+func parseProxyProtocolVersion(s string) (ProxyProtocolVersion, error) {
+	switch s {
+	case "v1", "1", "true":
+		return ProxyProtocolV1, nil
+	case "v2", "2":
+		return ProxyProtocolV2, nil
+	case "false", "":
+		return ProxyProtocolNone, nil
+	default:
+		return 0, fmt.Errorf("unknown PROXY protocol version: %s", s)
+	}
+}
+
+// UnmarshalYAML accepts both a boolean (`true` for v1) and a version string ("v1" or "v2").
+func (v *ProxyProtocolVersion) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		if enabled {
+			*v = ProxyProtocolV1
+		} else {
+			*v = ProxyProtocolNone
+		}
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	version, err := parseProxyProtocolVersion(s)
+	if err != nil {
+		return err
+	}
+	*v = version
+	return nil
+}
+
+// PROXY protocol v2 TLV types, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	// Sub-TLVs of ProxyTLVSSL.
+	ProxyTLVSSLVersion byte = 0x21
+	ProxyTLVSSLCN      byte = 0x22
+	ProxyTLVSSLCipher  byte = 0x23
+)
+
+// The client flags of ProxyTLVSSL.
+const (
+	proxyTLSClientSSL      byte = 0x01
+	proxyTLSClientCertConn byte = 0x02
+)
+
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader describes the original connection to be passed to the target with PROXY protocol.
+type ProxyHeader struct {
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+	// TLVs are only sent with PROXY protocol v2.
+	TLVs []ProxyTLV
+}
+
+// tcpAddrs returns the addresses as TCP addresses. ipv4 is false if either of them is IPv6, in which
+// case both are sent as IPv6. ok is false if either of the addresses is not a TCP address.
+func (h *ProxyHeader) tcpAddrs() (source, dest *net.TCPAddr, ipv4 bool, ok bool) {
+	if source, ok = h.SourceAddr.(*net.TCPAddr); !ok {
+		return
+	}
+	if dest, ok = h.DestAddr.(*net.TCPAddr); !ok {
+		return
+	}
+	ipv4 = source.IP.To4() != nil && dest.IP.To4() != nil
+	return
+}
+
+func (h *ProxyHeader) unixAddrs() (source, dest *net.UnixAddr, ok bool) {
+	if source, ok = h.SourceAddr.(*net.UnixAddr); !ok {
+		return
+	}
+	dest, ok = h.DestAddr.(*net.UnixAddr)
+	return
+}
+
+// EncodeV1 encodes the header in the human-readable format. Non-TCP connections are sent as "UNKNOWN".
+func (h *ProxyHeader) EncodeV1() []byte {
+	source, dest, ipv4, ok := h.tcpAddrs()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	var family string
+	var sourceIp, destIp string
+	if ipv4 {
+		family = "TCP4"
+		sourceIp, destIp = source.IP.To4().String(), dest.IP.To4().String()
+	} else {
+		// net.IP.String() formats IPv4-mapped addresses as IPv4, so format them manually.
+		family = "TCP6"
+		sourceIp, destIp = formatIPv6(source.IP), formatIPv6(dest.IP)
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, sourceIp, destIp, source.Port, dest.Port))
+}
+
+func formatIPv6(ip net.IP) string {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2VersionCommandProxy = 0x21
+
+	proxyV2FamilyUnspec     = 0x00
+	proxyV2FamilyTCP4       = 0x11
+	proxyV2FamilyTCP6       = 0x21
+	proxyV2FamilyUnixStream = 0x31
+
+	proxyV2UnixAddressLength = 108
+	proxyV2MaxPayloadLength  = 0xffff
+)
+
+// EncodeV2 encodes the header in the binary format. Connections which are neither TCP nor UNIX socket
+// are sent with the UNSPEC family.
+func (h *ProxyHeader) EncodeV2() ([]byte, error) {
+	var family byte
+	var addresses bytes.Buffer
+	if source, dest, ipv4, ok := h.tcpAddrs(); ok {
+		if ipv4 {
+			family = proxyV2FamilyTCP4
+			addresses.Write(source.IP.To4())
+			addresses.Write(dest.IP.To4())
+		} else {
+			family = proxyV2FamilyTCP6
+			addresses.Write(source.IP.To16())
+			addresses.Write(dest.IP.To16())
+		}
+		binary.Write(&addresses, binary.BigEndian, uint16(source.Port))
+		binary.Write(&addresses, binary.BigEndian, uint16(dest.Port))
+	} else if source, dest, ok := h.unixAddrs(); ok {
+		family = proxyV2FamilyUnixStream
+		for _, name := range []string{source.Name, dest.Name} {
+			if len(name) > proxyV2UnixAddressLength {
+				return nil, fmt.Errorf("UNIX socket path too long: %s", name)
+			}
+			path := make([]byte, proxyV2UnixAddressLength)
+			copy(path, name)
+			addresses.Write(path)
+		}
+	} else {
+		family = proxyV2FamilyUnspec
+	}
+
+	var payload bytes.Buffer
+	payload.Write(addresses.Bytes())
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xffff {
+			return nil, fmt.Errorf("TLV 0x%02x too long", tlv.Type)
+		}
+		payload.WriteByte(tlv.Type)
+		binary.Write(&payload, binary.BigEndian, uint16(len(tlv.Value)))
+		payload.Write(tlv.Value)
+	}
+	if payload.Len() > proxyV2MaxPayloadLength {
+		return nil, fmt.Errorf("PROXY protocol header too long")
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyV2Signature)
+	header.WriteByte(proxyV2VersionCommandProxy)
+	header.WriteByte(family)
+	binary.Write(&header, binary.BigEndian, uint16(payload.Len()))
+	header.Write(payload.Bytes())
+	return header.Bytes(), nil
+}
+
+// Encode encodes the header with the given PROXY protocol version.
+func (h *ProxyHeader) Encode(version ProxyProtocolVersion) ([]byte, error) {
+	switch version {
+	case ProxyProtocolV1:
+		return h.EncodeV1(), nil
+	case ProxyProtocolV2:
+		return h.EncodeV2()
+	default:
+		return nil, fmt.Errorf("invalid PROXY protocol version: %d", version)
+	}
+}
+
+const defaultProxyProtocolTimeout = 5 * time.Second
+
+const (
+	// The maximum length of a v1 header including the CRLF.
+	proxyV1MaxLength = 107
+
+	proxyV2VersionCommandLocal = 0x20
+
+	proxyV2FamilyUDP4       = 0x12
+	proxyV2FamilyUDP6       = 0x22
+	proxyV2FamilyUnixDgram  = 0x32
+	proxyV2AddressesLength4 = 12
+	proxyV2AddressesLength6 = 36
+)
+
+// ReadProxyHeader reads a v1 or v2 PROXY protocol header. For connections with the LOCAL command or
+// UNKNOWN / UNSPEC family, the addresses of the returned header are nil.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	// Any valid v1 header is longer than the v2 signature.
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, fmt.Errorf("no PROXY protocol header received")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("PROXY protocol v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &ProxyHeader{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header: %q", line)
+	}
+
+	var addrs [2]*net.TCPAddr
+	for i := range addrs {
+		ip, err := netip.ParseAddr(fields[2+i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid address in PROXY protocol v1 header: %v", err)
+		}
+		port, err := strconv.ParseUint(fields[4+i], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in PROXY protocol v1 header: %v", err)
+		}
+		addrs[i] = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port)))
+	}
+	return &ProxyHeader{SourceAddr: addrs[0], DestAddr: addrs[1]}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	versionCommand, family := fixed[12], fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if versionCommand != proxyV2VersionCommandProxy && versionCommand != proxyV2VersionCommandLocal {
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 version and command: 0x%02x", versionCommand)
+	}
+
+	header := &ProxyHeader{}
+	var addressesLength int
+	switch family {
+	case proxyV2FamilyTCP4, proxyV2FamilyUDP4, proxyV2FamilyTCP6, proxyV2FamilyUDP6:
+		ipLength := net.IPv4len
+		addressesLength = proxyV2AddressesLength4
+		if family == proxyV2FamilyTCP6 || family == proxyV2FamilyUDP6 {
+			ipLength = net.IPv6len
+			addressesLength = proxyV2AddressesLength6
+		}
+		if len(payload) < addressesLength {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 addresses")
+		}
+		sourceIp, _ := netip.AddrFromSlice(payload[:ipLength])
+		destIp, _ := netip.AddrFromSlice(payload[ipLength : 2*ipLength])
+		sourcePort := binary.BigEndian.Uint16(payload[2*ipLength:])
+		destPort := binary.BigEndian.Uint16(payload[2*ipLength+2:])
+		header.SourceAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(sourceIp, sourcePort))
+		header.DestAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(destIp, destPort))
+	case proxyV2FamilyUnixStream, proxyV2FamilyUnixDgram:
+		addressesLength = 2 * proxyV2UnixAddressLength
+		if len(payload) < addressesLength {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 addresses")
+		}
+		header.SourceAddr = &net.UnixAddr{Net: "unix", Name: unixAddressName(payload[:proxyV2UnixAddressLength])}
+		header.DestAddr = &net.UnixAddr{Net: "unix", Name: unixAddressName(payload[proxyV2UnixAddressLength:addressesLength])}
+	case proxyV2FamilyUnspec:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 family: 0x%02x", family)
+	}
+
+	for tlvs := payload[addressesLength:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 TLV")
+		}
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 TLV")
+		}
+		header.TLVs = append(header.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+length]})
+		tlvs = tlvs[3+length:]
+	}
+
+	if versionCommand == proxyV2VersionCommandLocal {
+		// Health checks from the proxy itself, the connection is not proxied.
+		header.SourceAddr, header.DestAddr = nil, nil
+	}
+	return header, nil
+}
+
+func unixAddressName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// ProxiedConn is an accepted connection whose PROXY protocol header has been consumed. Its addresses are
+// the ones carried by the header, if any.
+type ProxiedConn struct {
+	net.Conn
+	Header *ProxyHeader
+
+	reader *bufio.Reader
+}
+
+func (c *ProxiedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *ProxiedConn) RemoteAddr() net.Addr {
+	if c.Header.SourceAddr != nil {
+		return c.Header.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *ProxiedConn) LocalAddr() net.Addr {
+	if c.Header.DestAddr != nil {
+		return c.Header.DestAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn returns the underlying connection.
+func (c *ProxiedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// AcceptProxyHeader reads the PROXY protocol header of conn within timeout.
+func AcceptProxyHeader(conn net.Conn, timeout time.Duration) (*ProxiedConn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	header, err := ReadProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return &ProxiedConn{Conn: conn, Header: header, reader: reader}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"time"
+)
+
+// The time to wait for the writes to a changed config file to settle before reloading it.
+const configWatchDelay = 500 * time.Millisecond
+
+// WatchConfigFile sends to reloadCh whenever the content of the config file changes.
+func WatchConfigFile(filename string, reloadCh chan<- struct{}) error {
+	last, _ := os.ReadFile(filename)
+	events := make(chan struct{}, 1)
+	if err := watchFile(filename, events); err != nil {
+		return err
+	}
+
+	go func() {
+		for range events {
+			time.Sleep(configWatchDelay)
+			select {
+			case <-events:
+			default:
+			}
+
+			// Editors and Kubernetes ConfigMaps replace the file instead of writing to it, so the events are
+			// of the whole directory. Only reload if the content has actually changed.
+			content, err := os.ReadFile(filename)
+			if err != nil || bytes.Equal(content, last) {
+				continue
+			}
+			last = content
+			select {
+			case reloadCh <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
+
+// ReloadConfig loads the config again with the command-line arguments and applies the changes of services.
+// The Tailscale node is left alone, as are the connections of unchanged services. The error is also logged.
+func ReloadConfig(a *arguments, manager *ServiceManager, logger *Logger) error {
+	config, err := LoadConfig(a)
+	if err == nil {
+		err = config.ProcessServices()
+	}
+	if err != nil {
+		logger.Errorf("failed to reload config: %v", err)
+		return err
+	}
+
+	if !reflect.DeepEqual(config.Tailscale, manager.context.Config.Tailscale) {
+		logger.Errorf("changes of Tailscale config are ignored until restart")
+	}
+	if config.LogFormat != manager.context.Config.LogFormat {
+		logger.Errorf("changes of log format are ignored until restart")
+	}
+	if !reflect.DeepEqual(config.Metrics, manager.context.Config.Metrics) {
+		logger.Errorf("changes of metrics config are ignored until restart")
+	}
+	if !reflect.DeepEqual(config.Admin, manager.context.Config.Admin) {
+		logger.Errorf("changes of admin config are ignored until restart")
+	}
+	if err := manager.Apply(config); err != nil {
+		logger.Errorf("failed to reload config: %v", err)
+		return err
+	}
+	logger.Infof("reloaded config")
+	return nil
+}
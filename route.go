@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+type ServiceMode string
+
+const (
+	// Forward connections (or datagrams) as is.
+	ServiceModeForward ServiceMode = "forward"
+	// Forward HTTP requests, routed by host and path.
+	ServiceModeHTTP ServiceMode = "http"
+	// Forward TLS connections as is, routed by the server name in the ClientHello.
+	ServiceModeSNI ServiceMode = "sni"
+	// Forward connections as is, routed by the protocol detected from their first bytes.
+	ServiceModeMux ServiceMode = "mux"
+)
+
+// Route is a set of targets the matching requests of an HTTP service (or connections of an SNI or mux service)
+// are forwarded to.
+type Route struct {
+	// Lower case, empty for any host. A leading "*." matches any subdomain.
+	Host string
+	// Without the trailing slash, empty for any path.
+	Path      string
+	StripPath bool
+	// For mux mode, one of them is set.
+	Protocol string
+	Pattern  *regexp.Regexp
+
+	Targets  []*Target
+	Balancer Balancer
+	Retries  int
+}
+
+// Match reports whether a request of the host (which may have a port) and path is routed by the route.
+func (r *Route) Match(host, path string) bool {
+	if r.Host != "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if suffix, ok := strings.CutPrefix(r.Host, "*"); ok {
+			if !strings.HasSuffix(host, suffix) {
+				return false
+			}
+		} else if host != r.Host {
+			return false
+		}
+	}
+	if r.Path != "" {
+		rest, ok := strings.CutPrefix(path, r.Path)
+		if !ok || rest != "" && rest[0] != '/' {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Route) String() string {
+	if r.Protocol != "" {
+		return r.Protocol
+	}
+	if r.Pattern != nil {
+		return r.Pattern.String()
+	}
+	host := r.Host
+	if host == "" {
+		host = "*"
+	}
+	return host + r.Path
+}
+
+// createRoutes creates the routes of a service from its config, and adds the targets of them to the
+// targets of the service, so they're health checked and shown like others.
+func (s *Service) createRoutes() error {
+	for _, config := range s.Config.Routes {
+		route := &Route{
+			Host:      strings.ToLower(config.Host),
+			Path:      strings.TrimSuffix(config.Path, "/"),
+			StripPath: config.StripPath,
+			Protocol:  config.Protocol,
+		}
+		if config.Path != "" && !strings.HasPrefix(config.Path, "/") {
+			return fmt.Errorf("invalid route path: %s (must start with \"/\")", config.Path)
+		}
+		if _, ok := muxProtocolPrefixes[config.Protocol]; config.Protocol != "" && !ok {
+			return fmt.Errorf("unknown route protocol: %s", config.Protocol)
+		}
+		var err error
+		if config.Pattern != "" {
+			if route.Pattern, err = regexp.Compile(config.Pattern); err != nil {
+				return fmt.Errorf("invalid route pattern: %v", err)
+			}
+		}
+		if route.Targets, err = s.createTargets(config.Connect); err != nil {
+			return err
+		}
+		if route.Balancer, err = CreateBalancer(s.Config.Balance); err != nil {
+			return err
+		}
+		route.Retries = defaultRetries(s.Config, route.Targets)
+		s.Routes = append(s.Routes, route)
+	}
+	if len(s.Targets) > 0 {
+		s.Routes = append(s.Routes, &Route{Targets: s.Targets, Balancer: s.Balancer, Retries: s.Retries})
+	}
+	for _, route := range s.Routes[:len(s.Config.Routes)] {
+		s.Targets = append(s.Targets, route.Targets...)
+	}
+	return nil
+}
+
+func (s *Service) matchRoute(host, path string) *Route {
+	for _, route := range s.Routes {
+		if route.Match(host, path) {
+			return route
+		}
+	}
+	return nil
+}
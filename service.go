@@ -2,14 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tsnet"
 )
 
@@ -19,12 +24,102 @@ const (
 	AddressTCP AddressType = iota
 	AddressUNIXSocket
 	AddressTailscaleTCP
+	AddressUDP
+	AddressTailscaleUDP
+	AddressTLS
+	AddressTailscaleTLS
+	AddressFunnel
 )
 
+func (t AddressType) String() string {
+	switch t {
+	case AddressTCP:
+		return "tcp"
+	case AddressUNIXSocket:
+		return "unix"
+	case AddressTailscaleTCP:
+		return "tailscale"
+	case AddressUDP:
+		return "udp"
+	case AddressTailscaleUDP:
+		return "tailscale-udp"
+	case AddressTLS:
+		return "tls"
+	case AddressTailscaleTLS:
+		return "tailscale-tls"
+	case AddressFunnel:
+		return "funnel"
+	default:
+		return fmt.Sprintf("AddressType(%d)", int(t))
+	}
+}
+
+// IsDatagram reports whether the address type carries datagrams instead of a byte stream.
+func (t AddressType) IsDatagram() bool {
+	return t == AddressUDP || t == AddressTailscaleUDP
+}
+
+// IsTailscale reports whether the address type requires the Tailscale node.
+func (t AddressType) IsTailscale() bool {
+	return t == AddressTailscaleTCP || t == AddressTailscaleUDP || t == AddressTailscaleTLS || t == AddressFunnel
+}
+
+// IsTLS reports whether the address type carries TLS over TCP.
+func (t AddressType) IsTLS() bool {
+	return t == AddressTLS || t == AddressTailscaleTLS || t == AddressFunnel
+}
+
 type ServiceContext struct {
-	TsNet      *tsnet.Server
-	ShutdownCh chan struct{}
-	ShutdownWg *sync.WaitGroup
+	TsNet *tsnet.Server
+	// The config Tailscale is started with. Changes of it are not applied on reload.
+	Config  *Config
+	Logger  *Logger
+	Metrics *Metrics
+
+	tailscaleMu      sync.Mutex
+	tailscaleStarted bool
+
+	connectionsMu sync.Mutex
+	connections   map[string]*Connection
+	// Closed once there are no live connections, if someone is waiting for it.
+	idleCh chan struct{}
+}
+
+// StartTailscale starts the Tailscale node if it's not started yet.
+func (c *ServiceContext) StartTailscale() error {
+	c.tailscaleMu.Lock()
+	defer c.tailscaleMu.Unlock()
+	if c.tailscaleStarted {
+		return nil
+	}
+
+	if err := c.Config.ValidateTailscaleConfig(); err != nil {
+		return fmt.Errorf("Tailscale used but got invalid Tailscale config: %v", err)
+	}
+	if c.Config.Tailscale.AuthKey == "" {
+		c.Logger.Infof("Tailscale authkey not provided, will try interactive login")
+	}
+	if err := c.TsNet.Start(); err != nil {
+		return fmt.Errorf("failed to start Tailscale: %v", err)
+	}
+	c.tailscaleStarted = true
+	return nil
+}
+
+// TailscaleStarted reports whether the Tailscale node has been started.
+func (c *ServiceContext) TailscaleStarted() bool {
+	c.tailscaleMu.Lock()
+	defer c.tailscaleMu.Unlock()
+	return c.tailscaleStarted
+}
+
+// CloseTailscale closes the Tailscale node if it's started.
+func (c *ServiceContext) CloseTailscale() {
+	c.tailscaleMu.Lock()
+	defer c.tailscaleMu.Unlock()
+	if c.tailscaleStarted {
+		c.TsNet.Close()
+	}
 }
 
 type Service struct {
@@ -35,12 +130,41 @@ type Service struct {
 	ListenType           AddressType
 	ListenAddress        string
 	ListenPort           int16
-	ConnectType          AddressType
-	ConnectAddress       string
-	ConnectPort          int16
-	ConnectProxyProtocol bool
+	Targets              []*Target
+	Balancer             Balancer
+	Retries              int
+	HealthCheck          *HealthCheck
+	OutlierDetection     *OutlierDetection
+	ConnectProxyProtocol ProxyProtocolVersion
+	AcceptProxyProtocol  bool
+	TrustedProxies       []netip.Prefix
+	ProxyProtocolTimeout time.Duration
 	LogLevel             LogLevel
 	Timeout              time.Duration
+	SessionTimeout       time.Duration
+	SniffTimeout         time.Duration
+	IdleTimeout          time.Duration
+	MaxLifetime          time.Duration
+	ACL                  *ACL
+	Mode                 ServiceMode
+	// For HTTP, SNI and mux modes, in the order of matching. The connect targets of the service are the last route,
+	// matching everything, if any.
+	Routes []*Route
+	// For TLS listeners.
+	TLSConfig *tls.Config
+
+	// Set once the service is started, so that no series are registered for services never started.
+	metrics *serviceMetrics
+	pauseMu sync.Mutex
+	// Non-nil while the service is paused, closed on resume.
+	resumeCh chan struct{}
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	// Closed once the service starts listening or fails to, with the error in listenErr.
+	listening chan struct{}
+	listenErr error
+	// Closed once the service stops listening.
+	done chan struct{}
 }
 
 func parsePort(portString string) (int16, error) {
@@ -65,24 +189,44 @@ func parseUrl(urlType urlType, urlString string) (addressType AddressType, addre
 		e = fmt.Errorf("failed to parse %s URL: %v", urlType, err)
 	} else {
 		switch url.Scheme {
-		case "tcp":
+		case "tcp", "tls":
 			if port, err = parsePort(url.Port()); err != nil {
 				e = fmt.Errorf("failed to parse %s port: %v", urlType, err)
 			} else {
-				addressType = AddressTCP
+				if url.Scheme == "tcp" {
+					addressType = AddressTCP
+				} else {
+					addressType = AddressTLS
+				}
+				address = url.Hostname()
+			}
+		case "udp":
+			if port, err = parsePort(url.Port()); err != nil {
+				e = fmt.Errorf("failed to parse %s port: %v", urlType, err)
+			} else {
+				addressType = AddressUDP
 				address = url.Hostname()
 			}
 		case "unix":
 			addressType = AddressUNIXSocket
 			address = url.Path
-		case "tailscale":
+		case "tailscale", "tailscale-udp", "tailscale-tls", "funnel":
 			// Allowed ListenAddress for Tailscale is "::" or "0.0.0.0"
 			if urlType == urlTypeListen && (url.Hostname() != "::" && url.Hostname() != "0.0.0.0") {
 				e = fmt.Errorf("invalid Tailscale %s address: %s (only \"::\" and \"0.0.0.0\" allowed)", urlType, url.Hostname())
 			} else if port, err = parsePort(url.Port()); err != nil {
 				e = fmt.Errorf("failed to parse %s port: %v", urlType, err)
 			} else {
-				addressType = AddressTailscaleTCP
+				switch url.Scheme {
+				case "tailscale":
+					addressType = AddressTailscaleTCP
+				case "tailscale-udp":
+					addressType = AddressTailscaleUDP
+				case "tailscale-tls":
+					addressType = AddressTailscaleTLS
+				case "funnel":
+					addressType = AddressFunnel
+				}
 				address = url.Hostname()
 			}
 		default:
@@ -99,86 +243,438 @@ func CreateService(serviceContext *ServiceContext, name string, config *ServiceC
 		Name:                 name,
 		ConnectProxyProtocol: config.ProxyProtocol,
 		LogLevel:             config.LogLevel,
+		Mode:                 config.Mode,
 		Timeout:              config.Timeout,
+		SessionTimeout:       config.SessionTimeout,
+		SniffTimeout:         config.SniffTimeout,
+		IdleTimeout:          config.IdleTimeout,
+		MaxLifetime:          config.MaxLifetime,
+		AcceptProxyProtocol:  config.AcceptProxyProtocol,
+		ProxyProtocolTimeout: config.ProxyProtocolTimeout,
+		stopCh:               make(chan struct{}),
+		listening:            make(chan struct{}),
+		done:                 make(chan struct{}),
 	}
 	if service.ListenType, service.ListenAddress, service.ListenPort, err = parseUrl(urlTypeListen, config.Listen); err != nil {
 		return nil, err
 	}
-	if service.ConnectType, service.ConnectAddress, service.ConnectPort, err = parseUrl(urlTypeConnect, config.Connect); err != nil {
+	if service.Targets, err = service.createTargets(config.Connect); err != nil {
+		return nil, err
+	}
+	if service.Balancer, err = CreateBalancer(config.Balance); err != nil {
+		return nil, err
+	}
+	if config.Retries != nil && *config.Retries < 0 {
+		return nil, fmt.Errorf("invalid retries: %d", *config.Retries)
+	}
+	service.Retries = defaultRetries(config, service.Targets)
+	switch config.Mode {
+	case ServiceModeForward, "":
+		service.Mode = ServiceModeForward
+		if len(config.Routes) > 0 {
+			return nil, fmt.Errorf("routes require the HTTP, SNI or mux mode")
+		}
+	case ServiceModeHTTP:
+		if service.ListenType.IsDatagram() {
+			return nil, fmt.Errorf("HTTP mode is not supported for datagram services")
+		}
+		for _, route := range config.Routes {
+			if route.Protocol != "" || route.Pattern != "" {
+				return nil, fmt.Errorf("routes of HTTP mode match host and path only")
+			}
+		}
+		if err = service.createRoutes(); err != nil {
+			return nil, err
+		}
+	case ServiceModeSNI:
+		if service.ListenType.IsDatagram() || service.ListenType.IsTLS() {
+			return nil, fmt.Errorf("SNI mode requires a non-TLS stream listen address")
+		}
+		for _, route := range config.Routes {
+			if route.Path != "" || route.StripPath || route.Protocol != "" || route.Pattern != "" {
+				return nil, fmt.Errorf("routes of SNI mode match host only")
+			}
+		}
+		if err = service.createRoutes(); err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(service.Targets, func(target *Target) bool { return target.Type.IsTLS() }) {
+			return nil, fmt.Errorf("TLS connect addresses are not supported in SNI mode, which passes TLS through")
+		}
+	case ServiceModeMux:
+		if service.ListenType.IsDatagram() {
+			return nil, fmt.Errorf("mux mode is not supported for datagram services")
+		}
+		for _, route := range config.Routes {
+			if route.Host != "" || route.Path != "" || route.StripPath || (route.Protocol == "") == (route.Pattern == "") {
+				return nil, fmt.Errorf("routes of mux mode match either protocol or pattern only")
+			}
+		}
+		if err = service.createRoutes(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown service mode: %s", config.Mode)
+	}
+	if config.HealthCheck != nil {
+		if service.HealthCheck, err = CreateHealthCheck(config.HealthCheck, service.ListenType.IsDatagram()); err != nil {
+			return nil, err
+		}
+	}
+	if config.OutlierDetection != nil {
+		service.OutlierDetection = CreateOutlierDetection(config.OutlierDetection)
+	}
+	if service.ListenType.IsDatagram() && (service.ConnectProxyProtocol != ProxyProtocolNone || service.AcceptProxyProtocol) {
+		return nil, fmt.Errorf("PROXY protocol is not supported for datagram services")
+	}
+	for _, trustedProxy := range config.TrustedProxies {
+		prefix, err := parsePrefix(trustedProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %v", err)
+		}
+		service.TrustedProxies = append(service.TrustedProxies, prefix)
+	}
+	if service.AcceptProxyProtocol && len(service.TrustedProxies) == 0 && service.ListenType != AddressUNIXSocket {
+		return nil, fmt.Errorf("accepting PROXY protocol requires trusted proxies, except on UNIX socket listeners")
+	}
+	if service.ListenType == AddressFunnel && !slices.Contains(funnelPorts, service.ListenPort) {
+		return nil, fmt.Errorf("invalid Funnel listen port: %d (only 443, 8443 and 10000 allowed)", service.ListenPort)
+	}
+	if service.ListenType.IsTLS() {
+		if service.TLSConfig, err = service.CreateServerTLSConfig(); err != nil {
+			return nil, err
+		}
+	} else if config.TLS != nil {
+		return nil, fmt.Errorf("TLS options require a TLS listen address")
+	}
+	if config.ConnectTLS != nil && !slices.ContainsFunc(service.Targets, func(target *Target) bool { return target.Type.IsTLS() }) {
+		return nil, fmt.Errorf("connect TLS options require a TLS connect address")
+	}
+	if service.ACL, err = ParseACL(config.Allow, config.Deny, config.Groups); err != nil {
 		return nil, err
 	}
+	if service.ListenType.IsDatagram() && !service.ACL.IsEmpty() {
+		return nil, fmt.Errorf("ACLs are not supported for datagram services")
+	}
+	if service.ACL.HasIdentityRules() && !service.ListenType.IsTailscale() {
+		return nil, fmt.Errorf("Tailscale identity ACL rules require a Tailscale listen address")
+	}
+	if service.ACL.HasCertificateRules() && (service.TLSConfig == nil || service.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert) {
+		return nil, fmt.Errorf("client certificate ACL rules require a TLS listen address with client CAs")
+	}
+	if service.ListenType.IsDatagram() && (service.IdleTimeout != 0 || service.MaxLifetime != 0) {
+		return nil, fmt.Errorf("idle timeout and max lifetime are not supported for datagram services, use session timeout instead")
+	}
 	return
 }
 
+func (s *Service) createTargets(connects ConnectConfigs) (targets []*Target, err error) {
+	for _, connect := range connects {
+		target := &Target{
+			URL:    connect.URL,
+			Weight: connect.Weight,
+		}
+		if target.Type, target.Address, target.Port, err = parseUrl(urlTypeConnect, connect.URL); err != nil {
+			return nil, err
+		}
+		if s.ListenType.IsDatagram() != target.Type.IsDatagram() {
+			return nil, fmt.Errorf("cannot forward between stream and datagram addresses")
+		}
+		if target.Weight == 0 {
+			target.Weight = 1
+		} else if target.Weight < 0 {
+			return nil, fmt.Errorf("invalid weight of target %s: %d", target.URL, target.Weight)
+		}
+		if target.Dial, err = s.CreateConnector(target); err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// defaultRetries returns the retries of connecting to the targets, which are all the others with failover
+// if not configured.
+func defaultRetries(config *ServiceConfig, targets []*Target) int {
+	if config.Retries != nil {
+		return *config.Retries
+	} else if config.Balance == BalanceFailover {
+		return len(targets) - 1
+	}
+	return 0
+}
+
+// parsePrefix parses a CIDR, or a single IP as a prefix containing only itself.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
 func (s *Service) Listen() (listener net.Listener, cleanup func(), err error) {
-	switch s.ListenType {
-	case AddressTCP:
-		listener, err = net.Listen("tcp", net.JoinHostPort(s.ListenAddress, strconv.Itoa(int(s.ListenPort))))
+	return s.ServiceContext.Listen(s.ListenType, s.ListenAddress, s.ListenPort)
+}
+
+// Listen listens on a stream address, which is also used by the servers other than services. TLS addresses
+// are listened on as TCP, leaving the handshake to the caller.
+func (c *ServiceContext) Listen(addressType AddressType, address string, port int16) (listener net.Listener, cleanup func(), err error) {
+	switch addressType {
+	case AddressTCP, AddressTLS:
+		listener, err = net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(int(port))))
 		cleanup = func() {
 			listener.Close()
 		}
 	case AddressUNIXSocket:
-		listener, err = net.Listen("unix", s.ListenAddress)
+		listener, err = net.Listen("unix", address)
 		cleanup = func() {
 			listener.Close()
-			os.Remove(s.ListenAddress)
+			os.Remove(address)
 		}
-	case AddressTailscaleTCP:
-		listener, err = s.ServiceContext.TsNet.Listen("tcp", ":"+strconv.Itoa(int(s.ListenPort)))
+	case AddressTailscaleTCP, AddressTailscaleTLS:
+		listener, err = c.TsNet.Listen("tcp", ":"+strconv.Itoa(int(port)))
 		cleanup = func() {
 			listener.Close()
 		}
+	case AddressFunnel:
+		return c.listenFunnel(port)
 	default:
-		return nil, nil, fmt.Errorf("invalid listen address type: %v", s.ListenType)
+		return nil, nil, fmt.Errorf("invalid listen address type: %v", addressType)
 	}
 	return
 }
 
-func (s *Service) CreateConnector() (func() (net.Conn, error), error) {
-	switch s.ConnectType {
-	case AddressTCP:
-		return func() (net.Conn, error) {
-			return net.DialTimeout("tcp", s.ConnectAddress+":"+strconv.Itoa(int(s.ConnectPort)), s.Timeout)
-		}, nil
+func (s *Service) ListenPacket() (packetConn net.PacketConn, cleanup func(), err error) {
+	switch s.ListenType {
+	case AddressUDP:
+		packetConn, err = net.ListenPacket("udp", net.JoinHostPort(s.ListenAddress, strconv.Itoa(int(s.ListenPort))))
+		cleanup = func() {
+			packetConn.Close()
+		}
+	case AddressTailscaleUDP:
+		// tsnet requires the IP to listen on, so use the node's own Tailscale IP of the requested family.
+		// Waiting for Tailscale is given up once the service is stopped.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-s.stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		var status *ipnstate.Status
+		if status, err = s.ServiceContext.TsNet.Up(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to wait for Tailscale: %v", err)
+		}
+		var ip netip.Addr
+		for _, tsIp := range status.TailscaleIPs {
+			if tsIp.Is4() == (s.ListenAddress == "0.0.0.0") {
+				ip = tsIp
+				break
+			}
+		}
+		if !ip.IsValid() {
+			return nil, nil, fmt.Errorf("no Tailscale IP available for %s", s.ListenAddress)
+		}
+		packetConn, err = s.ServiceContext.TsNet.ListenPacket("udp", netip.AddrPortFrom(ip, uint16(s.ListenPort)).String())
+		cleanup = func() {
+			packetConn.Close()
+		}
+	default:
+		return nil, nil, fmt.Errorf("invalid datagram listen address type: %v", s.ListenType)
+	}
+	return
+}
+
+// CreateConnector creates the function dialing a target within the context, which covers the TLS handshake
+// too. The PROXY protocol header passed to it, if any, is written before anything else, which is before the
+// TLS handshake for TLS targets.
+func (s *Service) CreateConnector(target *Target) (func(ctx context.Context, header []byte) (net.Conn, error), error) {
+	address := net.JoinHostPort(target.Address, strconv.Itoa(int(target.Port)))
+	var dial func(ctx context.Context) (net.Conn, error)
+	switch target.Type {
+	case AddressTCP, AddressTLS:
+		dial = func(ctx context.Context) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "tcp", address)
+		}
+	case AddressUDP:
+		dial = func(ctx context.Context) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", address)
+		}
 	case AddressUNIXSocket:
-		return func() (net.Conn, error) {
-			return net.DialTimeout("unix", s.ConnectAddress, s.Timeout)
-		}, nil
-	case AddressTailscaleTCP:
-		return func() (net.Conn, error) {
-			ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
-			defer cancel()
-			return s.ServiceContext.TsNet.Dial(ctx, "tcp", s.ConnectAddress+":"+strconv.Itoa(int(s.ConnectPort)))
-		}, nil
+		dial = func(ctx context.Context) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", target.Address)
+		}
+	case AddressTailscaleTCP, AddressTailscaleTLS:
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return s.ServiceContext.TsNet.Dial(ctx, "tcp", address)
+		}
+	case AddressTailscaleUDP:
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return s.ServiceContext.TsNet.Dial(ctx, "udp", address)
+		}
 	default:
-		return nil, fmt.Errorf("invalid connect address type: %v", s.ConnectType)
+		return nil, fmt.Errorf("invalid connect address type: %v", target.Type)
+	}
+
+	var tlsConfig *tls.Config
+	if target.Type.IsTLS() {
+		var err error
+		if tlsConfig, err = s.CreateClientTLSConfig(target); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(ctx context.Context, header []byte) (net.Conn, error) {
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) > 0 {
+			if _, err := conn.Write(header); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("failed to write PROXY protocol header: %v", err)
+			}
+		}
+		if tlsConfig == nil {
+			return conn, nil
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, &tlsHandshakeError{err}
+		}
+		return tlsConn, nil
+	}, nil
+}
+
+// UsesTailscale reports whether the service listens on or connects to Tailscale.
+func (s *Service) UsesTailscale() bool {
+	if s.ListenType.IsTailscale() {
+		return true
+	}
+	for _, target := range s.Targets {
+		if target.Type.IsTailscale() {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop stops the service from accepting new connections and waits for its listener to be closed. Connections
+// already accepted are not interrupted, but datagram sessions are closed with the listener they reply from.
+func (s *Service) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	<-s.done
+}
+
+// WaitListening waits up to timeout for the started service to start listening, returning the error if it fails
+// to.
+func (s *Service) WaitListening(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.listening:
+		return s.listenErr
+	case <-timer.C:
+		return fmt.Errorf("not listening after %v", timeout)
+	}
+}
+
+// listened reports the service started listening, or failed to with err.
+func (s *Service) listened(err error) {
+	s.listenErr = err
+	close(s.listening)
+}
+
+// Pause makes the service stop handling new connections (or datagrams) until resumed, leaving them queued
+// in the listener. It returns false if the service is already paused.
+func (s *Service) Pause() bool {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	if s.resumeCh != nil {
+		return false
+	}
+	s.resumeCh = make(chan struct{})
+	return true
+}
+
+// Resume resumes a paused service. It returns false if the service is not paused.
+func (s *Service) Resume() bool {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	if s.resumeCh == nil {
+		return false
+	}
+	close(s.resumeCh)
+	s.resumeCh = nil
+	return true
+}
+
+func (s *Service) Paused() bool {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	return s.resumeCh != nil
+}
+
+// waitResumed blocks while the service is paused. It returns false if the service is stopped meanwhile.
+func (s *Service) waitResumed() bool {
+	s.pauseMu.Lock()
+	resumeCh := s.resumeCh
+	s.pauseMu.Unlock()
+	if resumeCh == nil {
+		return true
+	}
+	select {
+	case <-resumeCh:
+		return true
+	case <-s.stopCh:
+		return false
 	}
 }
 
 func (s *Service) Start() {
+	defer close(s.done)
 	logger := CreateLogger("services/"+s.Name, s.LogLevel)
 
-	listener, cleanup, err := s.Listen()
-	if err != nil {
-		logger.Errorf("failed to create listener: %v", err)
-		return
+	s.startHealthChecks(logger)
+
+	if s.ListenType.IsDatagram() {
+		s.serveDatagram(logger)
+	} else {
+		s.serveStream(logger)
 	}
+}
 
-	connector, err := s.CreateConnector()
+func (s *Service) serveStream(logger *Logger) {
+	listener, cleanup, err := s.Listen()
+	s.listened(err)
 	if err != nil {
-		logger.Errorf("failed to create connector: %v", err)
+		logger.Errorf("failed to create listener: %v", err)
 		return
 	}
 
 	logger.Infof("listening on %s", s.Config.Listen)
-	s.ServiceContext.ShutdownWg.Add(1)
 
 	connCh := make(chan net.Conn)
 	go func() {
 		for {
 			conn, err := listener.Accept()
 			select {
-			case <-s.ServiceContext.ShutdownCh:
+			case <-s.stopCh:
+				if err == nil {
+					conn.Close()
+				}
 				return
 			default:
 				if err != nil {
@@ -186,60 +682,260 @@ func (s *Service) Start() {
 					continue
 				}
 				logger.Verbosef("accepted connection from %v", conn.RemoteAddr())
-				connCh <- conn
+				// The accepting may have begun before pausing, so the connection is held until resumed.
+				if !s.waitResumed() {
+					conn.Close()
+					return
+				}
+				select {
+				case connCh <- conn:
+				case <-s.stopCh:
+					conn.Close()
+					return
+				}
 			}
 		}
 	}()
 
 	for {
 		select {
-		case <-s.ServiceContext.ShutdownCh:
+		case <-s.stopCh:
 			cleanup()
-			s.ServiceContext.ShutdownWg.Done()
+			logger.Infof("stopped listening on %s", s.Config.Listen)
 			return
 		case conn := <-connCh:
-			go func() {
-				targetConn, err := connector()
-				if err != nil {
-					logger.Errorf("failed to connect to target: %v", err)
-					conn.Close()
-					return
-				}
-				logger.Verbosef("connected to target %v", targetConn.RemoteAddr())
-
-				if s.Config.ProxyProtocol {
-					varsion, remoteIp, remotePort := tryExtractAddr(conn.RemoteAddr())
-					_, localIp, localPort := tryExtractAddr(conn.LocalAddr())
-					header := fmt.Sprintf("PROXY TCP%d %s %s %d %d\r\n", varsion, remoteIp, localIp, remotePort, localPort)
-					logger.Verbosef("writing PROXY Protocol header: %v", header)
-					if _, err := targetConn.Write([]byte(header)); err != nil {
-						logger.Errorf("failed to write PROXY Protocol header: %v", err)
-						targetConn.Close()
-						conn.Close()
-						return
-					}
-				}
+			c := &Connection{
+				ID:        newConnectionID(),
+				Service:   s.Name,
+				Conn:      conn,
+				StartTime: time.Now(),
+			}
+			_, c.Funnel = conn.(*funnelConn)
+			// Tracked before the service can stop, so that the drain on shutdown waits for it.
+			untrack := s.ServiceContext.trackConnection(c)
+			go s.handleConn(logger, c, untrack)
+		}
+	}
+}
+
+// handleConn forwards an accepted connection, then calls untrack.
+func (s *Service) handleConn(logger *Logger, c *Connection, untrack func()) {
+	conn := c.Conn
+	closed := s.metrics.connectionStarted()
+	defer untrack()
+	// Every connection gets an access log record, including the rejected ones.
+	var reason string
+	defer func() {
+		closed(c.logAccess(logger, reason))
+	}()
+	defer c.watchTimeouts(s.IdleTimeout, s.MaxLifetime)()
 
-				PipeAndClose(conn, targetConn, logger)
-			}()
+	if s.AcceptProxyProtocol {
+		if !s.isTrustedProxy(conn.RemoteAddr()) {
+			logger.Errorf("rejected connection %s from untrusted proxy %v", c.ID, conn.RemoteAddr())
+			conn.Close()
+			reason = closeReasonUntrustedProxy
+			return
+		}
+		proxiedConn, err := AcceptProxyHeader(conn, s.ProxyProtocolTimeout)
+		if err != nil {
+			logger.Errorf("failed to read PROXY protocol header of connection %s from %v: %v", c.ID, conn.RemoteAddr(), err)
+			conn.Close()
+			reason = closeReasonBadProxyHeader
+			return
 		}
+		logger.Verbosef("connection %s from proxy %v is from %v", c.ID, conn.RemoteAddr(), proxiedConn.RemoteAddr())
+		c.mu.Lock()
+		c.Conn = proxiedConn
+		c.mu.Unlock()
 	}
+
+	if s.TLSConfig != nil {
+		tlsConn := tls.Server(c.Conn, s.TLSConfig)
+		ctx, cancel := timeoutContext(s.Timeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			logger.Errorf("failed TLS handshake of connection %s from %v: %v", c.ID, c.Conn.RemoteAddr(), err)
+			c.Conn.Close()
+			reason = closeReasonTLSHandshakeFailed
+			return
+		}
+		state := tlsConn.ConnectionState()
+		logger.Verbosef("TLS handshake of connection %s done with server name %q", c.ID, state.ServerName)
+		c.mu.Lock()
+		c.Conn = tlsConn
+		c.TLS = &state
+		c.ServerName = state.ServerName
+		if len(state.PeerCertificates) > 0 {
+			c.Certificate = state.PeerCertificates[0]
+		}
+		c.mu.Unlock()
+		if c.Certificate != nil {
+			logger.Infof("connection %s from %v is %s", c.ID, c.Conn.RemoteAddr(), c.Certificate.Subject)
+		}
+	}
+
+	// Funnel connections are from the internet instead of tailnet peers. The identity is looked up by the socket
+	// peer, so not for clients behind a proxy sending PROXY protocol, unless the header is from the client itself.
+	if s.ListenType.IsTailscale() && !c.Funnel && sameIP(conn.RemoteAddr(), c.Conn.RemoteAddr()) {
+		ctx, cancel := timeoutContext(s.Timeout)
+		identity, err := s.ServiceContext.WhoIs(ctx, conn.RemoteAddr())
+		cancel()
+		if err != nil {
+			logger.Errorf("failed to look up Tailscale identity of connection %s from %v: %v", c.ID, c.Conn.RemoteAddr(), err)
+			// Neither allow nor deny rules by identity could be trusted without it.
+			if s.ACL.HasIdentityRules() {
+				c.Conn.Close()
+				reason = closeReasonDenied
+				return
+			}
+		} else if identity != nil {
+			c.mu.Lock()
+			c.Identity = identity
+			c.mu.Unlock()
+			logger.Infof("connection %s from %v is %v", c.ID, c.Conn.RemoteAddr(), identity)
+		}
+	}
+
+	if allowed, why := s.ACL.Check(c.Conn.RemoteAddr(), c.Identity, c.Certificate); !allowed {
+		logger.Infof("rejected connection %s from %v: %s", c.ID, c.Conn.RemoteAddr(), why)
+		c.Conn.Close()
+		reason = closeReasonDenied
+		return
+	}
+
+	if s.Mode == ServiceModeHTTP {
+		reason = s.serveHTTP(logger, c)
+		return
+	}
+
+	targets, balancer, retries := s.Targets, s.Balancer, s.Retries
+	if s.Mode == ServiceModeSNI {
+		serverName, peekedConn, err := PeekClientHello(c.Conn, s.Timeout)
+		if err != nil {
+			logger.Errorf("failed to read TLS ClientHello of connection %s from %v: %v", c.ID, c.Conn.RemoteAddr(), err)
+			c.Conn.Close()
+			reason = closeReasonTLSHandshakeFailed
+			return
+		}
+		c.mu.Lock()
+		c.Conn = peekedConn
+		c.ServerName = serverName
+		c.mu.Unlock()
+		route := s.matchRoute(serverName, "")
+		if route == nil {
+			logger.Infof("rejected connection %s from %v: no route for server name %q", c.ID, c.Conn.RemoteAddr(), serverName)
+			c.Conn.Close()
+			reason = closeReasonNoRoute
+			return
+		}
+		logger.Verbosef("connection %s with server name %q is routed by %s", c.ID, serverName, route)
+		c.mu.Lock()
+		c.Route = route.String()
+		c.mu.Unlock()
+		targets, balancer, retries = route.Targets, route.Balancer, route.Retries
+	} else if s.Mode == ServiceModeMux {
+		route, sniffedConn, err := s.sniffRoute(c.Conn)
+		if err != nil {
+			logger.Verbosef("connection %s from %v closed before detecting protocol: %v", c.ID, c.Conn.RemoteAddr(), err)
+			c.Conn.Close()
+			reason = closeReasonClientClosed
+			return
+		}
+		c.mu.Lock()
+		c.Conn = sniffedConn
+		c.mu.Unlock()
+		if route == nil {
+			logger.Infof("rejected connection %s from %v: no route for protocol", c.ID, c.Conn.RemoteAddr())
+			c.Conn.Close()
+			reason = closeReasonNoRoute
+			return
+		}
+		logger.Verbosef("connection %s is routed by %s", c.ID, route)
+		c.mu.Lock()
+		c.Route = route.String()
+		c.mu.Unlock()
+		targets, balancer, retries = route.Targets, route.Balancer, route.Retries
+	}
+
+	var header []byte
+	if s.ConnectProxyProtocol != ProxyProtocolNone {
+		var err error
+		if header, err = s.proxyProtocolHeader(c).Encode(s.ConnectProxyProtocol); err != nil {
+			logger.Errorf("failed to encode PROXY protocol header: %v", err)
+			c.Conn.Close()
+			reason = closeReasonError
+			return
+		}
+		logger.Verbosef("writing PROXY protocol header: %q", header)
+	}
+
+	targetConn, target, err := s.connectTo(logger, c.Conn.RemoteAddr(), header, targets, balancer, retries)
+	if err != nil {
+		logger.Errorf("failed to connect to target %s: %v", target.URL, err)
+		c.Conn.Close()
+		reason = closeReasonDialFailed
+		return
+	}
+	defer target.Release()
+	if !c.connected(target, targetConn) {
+		logger.Infof("connection %s closed while connecting to target %s", c.ID, target.URL)
+		targetConn.Close()
+		return
+	}
+	logger.Verbosef("connected to target %s (%v) for connection %s", target.URL, targetConn.RemoteAddr(), c.ID)
+
+	reason = PipeAndClose(c.Conn, targetConn, logger, func(n int64) {
+		c.BytesIn.Add(n)
+		c.Touch()
+		s.metrics.bytesIn.Add(n)
+	}, func(n int64) {
+		c.BytesOut.Add(n)
+		c.Touch()
+		s.metrics.bytesOut.Add(n)
+	})
 }
 
-func tryExtractAddr(addr net.Addr) (version int, ip string, port int) {
-	switch addr := addr.(type) {
-	case *net.TCPAddr:
-		if addr.IP.To4() == nil {
-			version = 6
-		} else {
-			version = 4
+// isTrustedProxy reports whether PROXY protocol headers from addr are accepted. UNIX socket peers, which are
+// restricted by file permission, are always trusted, and others only if in the trusted proxies.
+func (s *Service) isTrustedProxy(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		_, isUnix := addr.(*net.UnixAddr)
+		return isUnix
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range s.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
 		}
-		ip = addr.IP.String()
-		port = addr.Port
-	default:
-		version = 4
-		ip = "0.0.0.0"
-		port = 0
 	}
-	return
+	return false
+}
+
+// sameIP reports whether both addresses are TCP addresses of the same IP.
+func sameIP(a, b net.Addr) bool {
+	tcpA, okA := a.(*net.TCPAddr)
+	tcpB, okB := b.(*net.TCPAddr)
+	return okA && okB && tcpA.AddrPort().Addr().Unmap() == tcpB.AddrPort().Addr().Unmap()
+}
+
+func (s *Service) proxyProtocolHeader(c *Connection) *ProxyHeader {
+	header := &ProxyHeader{
+		SourceAddr: c.Conn.RemoteAddr(),
+		DestAddr:   c.Conn.LocalAddr(),
+	}
+	if s.Config.ProxyProtocolAuthority != "" {
+		header.TLVs = append(header.TLVs, ProxyTLV{Type: ProxyTLVAuthority, Value: []byte(s.Config.ProxyProtocolAuthority)})
+	}
+	header.TLVs = append(header.TLVs, ProxyTLV{Type: ProxyTLVUniqueID, Value: []byte(c.ID)})
+	if c.Identity != nil {
+		header.TLVs = append(header.TLVs, c.Identity.ProxyTLVs()...)
+	}
+	// Kept from the handshake, since the TLS connection is wrapped in mux mode.
+	if c.TLS != nil {
+		header.TLVs = append(header.TLVs, proxyTLSTLV(*c.TLS))
+	}
+	return header
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// errClientHelloRead stops the TLS handshake used to parse a ClientHello once it's read.
+var errClientHelloRead = errors.New("ClientHello read")
+
+// readOnlyConn lets crypto/tls read a ClientHello from a connection without writing anything back.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *readOnlyConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekedConn is a connection whose bytes already read are replayed before reading on.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// NetConn returns the underlying connection.
+func (c *peekedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// PeekClientHello reads the TLS ClientHello of a connection within the timeout, returning the server name
+// (empty if not sent) and the connection replaying the ClientHello, to be forwarded as is.
+func PeekClientHello(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	var peeked bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	err := tls.Server(&readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	if hello == nil {
+		return "", nil, err
+	}
+	return hello.ServerName, &peekedConn{Conn: conn, peeked: peeked.Bytes()}, nil
+}
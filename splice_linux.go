@@ -0,0 +1,126 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The most bytes moved by a splice, which is also the size of the pipes.
+const maxSpliceSize = 1 << 20
+
+// splicePipe is a pipe the spliced bytes are moved through, from the source socket to the destination one.
+type splicePipe struct {
+	r, w int
+}
+
+func newSplicePipe() *splicePipe {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return nil
+	}
+	// A larger pipe moves more bytes per splice. Fine to fail, e.g. over the limit of unprivileged users.
+	unix.FcntlInt(uintptr(fds[0]), unix.F_SETPIPE_SZ, maxSpliceSize)
+	p := &splicePipe{r: fds[0], w: fds[1]}
+	runtime.SetFinalizer(p, (*splicePipe).close)
+	return p
+}
+
+func (p *splicePipe) close() {
+	unix.Close(p.r)
+	unix.Close(p.w)
+}
+
+// Pipes are reused across connections, and closed once collected.
+var splicePipePool = sync.Pool{
+	New: func() any {
+		return newSplicePipe()
+	},
+}
+
+// release puts the pipe back to the pool if drained. A pipe with bytes left in it is closed instead, since they
+// would be forwarded to the next connection using it.
+func (p *splicePipe) release(inPipe int64) {
+	if inPipe > 0 {
+		runtime.SetFinalizer(p, nil)
+		p.close()
+		return
+	}
+	splicePipePool.Put(p)
+}
+
+// spliceConn forwards from src to dst until EOF with splice(2), without copying through user space, reporting
+// the bytes forwarded to count. It reports false if splice is not available, in which case nothing is read.
+func spliceConn(dst, src syscall.Conn, count func(n int64)) (handled bool, err error) {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	p, _ := splicePipePool.Get().(*splicePipe)
+	if p == nil {
+		return false, nil
+	}
+	// Bytes left in the pipe, which is not reused if not drained.
+	var inPipe int64
+	defer func() {
+		p.release(inPipe)
+	}()
+
+	for {
+		var spliceErr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			for {
+				inPipe, spliceErr = unix.Splice(int(fd), nil, p.w, nil, maxSpliceSize, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				if spliceErr != unix.EINTR {
+					break
+				}
+			}
+			// Wait for the socket to be readable.
+			return spliceErr != unix.EAGAIN
+		})
+		if err == nil {
+			err = spliceErr
+		}
+		if err != nil {
+			inPipe = 0
+			return true, err
+		}
+		if inPipe == 0 {
+			return true, nil
+		}
+
+		for inPipe > 0 {
+			var n int64
+			err := dstRaw.Write(func(fd uintptr) bool {
+				for {
+					n, spliceErr = unix.Splice(p.r, nil, int(fd), nil, int(inPipe), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+					if spliceErr != unix.EINTR {
+						break
+					}
+				}
+				// Wait for the socket to be writable.
+				return spliceErr != unix.EAGAIN
+			})
+			if err == nil {
+				err = spliceErr
+			}
+			if err == nil && n == 0 {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return true, err
+			}
+			inPipe -= n
+			count(n)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// isOpen tells whether the file descriptor is open.
+func isOpen(fd int) bool {
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	return err == nil
+}
+
+// A pipe with bytes left by a failed write is closed, instead of being put back to the pool.
+func TestSplicePipeReleaseDirty(t *testing.T) {
+	p := newSplicePipe()
+	if p == nil {
+		t.Skip("pipes are not available")
+	}
+	n, err := unix.Write(p.w, []byte("left over"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.release(int64(n))
+	if isOpen(p.r) || isOpen(p.w) {
+		t.Fatal("pipe with bytes left not closed")
+	}
+}
+
+// A drained pipe is kept open for reuse.
+func TestSplicePipeReleaseDrained(t *testing.T) {
+	p := newSplicePipe()
+	if p == nil {
+		t.Skip("pipes are not available")
+	}
+	p.release(0)
+	if !isOpen(p.r) || !isOpen(p.w) {
+		t.Fatal("drained pipe closed")
+	}
+}
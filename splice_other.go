@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// spliceConn reports false since splice(2) is not available.
+func spliceConn(dst, src syscall.Conn, count func(n int64)) (handled bool, err error) {
+	return false, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// keyPairLoader loads a certificate and its key from PEM files, and loads them again once the files are
+// modified (e.g. renewed), so the service doesn't need to be restarted for new certificates.
+type keyPairLoader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func (l *keyPairLoader) load() (*tls.Certificate, error) {
+	certInfo, err := os.Stat(l.certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := os.Stat(l.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.certificate != nil && certInfo.ModTime().Equal(l.certModTime) && keyInfo.ModTime().Equal(l.keyModTime) {
+		return l.certificate, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	l.certificate = &certificate
+	l.certModTime = certInfo.ModTime()
+	l.keyModTime = keyInfo.ModTime()
+	return l.certificate, nil
+}
+
+func (l *keyPairLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate, err := l.load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	return certificate, nil
+}
+
+// getTailscaleCertificate fetches the certificate of the node's tailnet domain from Tailscale, which requires
+// HTTPS to be enabled for the tailnet. Clients not sending SNI (e.g. connecting by IP) get the certificate of
+// the first domain.
+func (c *ServiceContext) getTailscaleCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	domains := c.TsNet.CertDomains()
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("no Tailscale certificate available, enable MagicDNS and HTTPS for the tailnet first")
+	}
+	if hello.ServerName == "" {
+		withServerName := *hello
+		withServerName.ServerName = domains[0]
+		hello = &withServerName
+	}
+	localClient, err := c.TsNet.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	return localClient.GetCertificate(hello)
+}
+
+// CreateServerTLSConfig creates the config terminating TLS of connections accepted by a TLS listener, with the
+// certificate files of the service, or the Tailscale certificate for a Tailscale TLS listener by default.
+func (s *Service) CreateServerTLSConfig() (*tls.Config, error) {
+	config := s.Config.TLS
+	if config == nil {
+		config = &TLSListenConfig{}
+	}
+	if (config.Cert == "") != (config.Key == "") {
+		return nil, fmt.Errorf("both TLS certificate and key required")
+	}
+
+	tlsConfig := &tls.Config{}
+	var err error
+	if config.Cert != "" {
+		loader := &keyPairLoader{certFile: config.Cert, keyFile: config.Key}
+		if _, err := loader.load(); err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		tlsConfig.GetCertificate = loader.GetCertificate
+	} else if s.ListenType.IsTailscale() {
+		tlsConfig.GetCertificate = s.ServiceContext.getTailscaleCertificate
+	} else {
+		return nil, fmt.Errorf("missing TLS certificate and key for TLS listener")
+	}
+	if config.ClientCA != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(config.ClientCA); err != nil {
+			return nil, fmt.Errorf("invalid TLS client CA: %v", err)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool loads a PEM CA bundle.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", filename)
+	}
+	return pool, nil
+}
+
+// certificateSANs returns the DNS names, email addresses, IPs and URIs of a certificate.
+func certificateSANs(certificate *x509.Certificate) []string {
+	sans := slices.Clone(certificate.DNSNames)
+	sans = append(sans, certificate.EmailAddresses...)
+	for _, ip := range certificate.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range certificate.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// proxyTLSTLV returns the PP2_TYPE_SSL TLV describing a connection accepted by a TLS listener, with the
+// common name of the client certificate if presented, to pass to the target with PROXY protocol v2. Client
+// certificates are always verified, so the verify field is always 0.
+func proxyTLSTLV(state tls.ConnectionState) ProxyTLV {
+	client := proxyTLSClientSSL
+	if len(state.PeerCertificates) > 0 {
+		client |= proxyTLSClientCertConn
+	}
+	value := []byte{client, 0, 0, 0, 0}
+	appendSubTLV := func(subType byte, subValue string) {
+		value = append(value, subType, byte(len(subValue)>>8), byte(len(subValue)))
+		value = append(value, subValue...)
+	}
+	appendSubTLV(ProxyTLVSSLVersion, fmt.Sprintf("TLSv1.%d", state.Version-tls.VersionTLS10))
+	appendSubTLV(ProxyTLVSSLCipher, tls.CipherSuiteName(state.CipherSuite))
+	if len(state.PeerCertificates) > 0 {
+		appendSubTLV(ProxyTLVSSLCN, state.PeerCertificates[0].Subject.CommonName)
+	}
+	return ProxyTLV{Type: ProxyTLVSSL, Value: value}
+}
+
+// tlsHandshakeError is a failure of the TLS handshake with a target after connecting to it.
+type tlsHandshakeError struct {
+	err error
+}
+
+func (e *tlsHandshakeError) Error() string {
+	return fmt.Sprintf("TLS handshake failed: %v", e.err)
+}
+
+func (e *tlsHandshakeError) Unwrap() error {
+	return e.err
+}
+
+// CreateClientTLSConfig creates the config originating TLS to a TLS target of the service. The server name is
+// the host of the target by default.
+func (s *Service) CreateClientTLSConfig(target *Target) (*tls.Config, error) {
+	config := s.Config.ConnectTLS
+	if config == nil {
+		config = &TLSConnectConfig{}
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		NextProtos:         config.ALPN,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = target.Address
+	}
+	if config.CA != "" {
+		var err error
+		if tlsConfig.RootCAs, err = loadCertPool(config.CA); err != nil {
+			return nil, fmt.Errorf("invalid TLS CA bundle: %v", err)
+		}
+	}
+	if (config.Cert == "") != (config.Key == "") {
+		return nil, fmt.Errorf("both TLS client certificate and key required")
+	}
+	if config.Cert != "" {
+		loader := &keyPairLoader{certFile: config.Cert, keyFile: config.Key}
+		if _, err := loader.load(); err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate: %v", err)
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loader.GetCertificate(nil)
+		}
+	}
+	return tlsConfig, nil
+}
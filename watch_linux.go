@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchFile sends to events on any change in the directory of filename, with inotify.
+func watchFile(filename string, events chan<- struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM)
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(filename), mask); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			if _, err := unix.Read(fd, buf); err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"time"
+)
+
+const configPollInterval = 2 * time.Second
+
+// watchFile sends to events periodically, since inotify is not available.
+func watchFile(filename string, events chan<- struct{}) error {
+	go func() {
+		for range time.Tick(configPollInterval) {
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
+}